@@ -18,11 +18,14 @@ package config
 
 const AudioKey = "audio"
 
+var AudioSection = TypedSection[Audio]{key: AudioKey}
+
 func init() {
 	allSections[AudioKey] = section{
 		key:         AudioKey,
 		mapToStruct: audioMapToStruct,
-		validate:    noValidateFunc,
+		validate:    validateAudio,
+		defaults:    DefaultAudio(),
 	}
 }
 
@@ -47,3 +50,15 @@ func audioMapToStruct(m map[string]interface{}) (interface{}, error) {
 	}
 	return s, nil
 }
+
+func validateAudio(s interface{}) error {
+	a, ok := s.(Audio)
+	if !ok {
+		return nil
+	}
+	errs := newFieldErrors(AudioKey)
+	if a.Card < 0 {
+		errs.add("card", a.Card, "can not be negative")
+	}
+	return errs.err()
+}
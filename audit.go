@@ -0,0 +1,146 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	toml "github.com/pelletier/go-toml"
+)
+
+// DefaultAuditLogFile is where changes are audited to by default.
+const DefaultAuditLogFile = "/var/log/cacophony/config-audit.log"
+
+// AuditEntry describes a change made to the config.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Op       string    `json:"op"`
+	Sections []string  `json:"sections"`
+	Changes  []Change  `json:"changes"`
+	Process  string    `json:"process"`
+	PID      int       `json:"pid"`
+	Tag      string    `json:"tag,omitempty"`
+}
+
+// AuditSink is given an entry for each change made to the config.
+type AuditSink interface {
+	Audit(entry AuditEntry) error
+}
+
+// FileAuditSink appends audit entries to a file as JSON lines.
+type FileAuditSink struct {
+	Path string
+}
+
+// auditMu stops sinks in the same process from appending to a file at the
+// same time, as appending isn't atomic on every fs.
+var auditMu sync.Mutex
+
+func NewFileAuditSink(path string) *FileAuditSink {
+	return &FileAuditSink{Path: path}
+}
+
+func (s *FileAuditSink) Audit(entry AuditEntry) error {
+	if err := fs.MkdirAll(path.Dir(s.Path), 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := fs.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// settingsChanges returns the changes from the old to the new settings.
+func settingsChanges(old, new map[string]interface{}) ([]Change, error) {
+	oldSettings, err := normalizeSettings(old)
+	if err != nil {
+		return nil, err
+	}
+	newSettings, err := normalizeSettings(new)
+	if err != nil {
+		return nil, err
+	}
+	return DiffSettings(oldSettings, newSettings), nil
+}
+
+// audit sends the changes to the audit sink. Values in secret sections are
+// redacted.
+func (c *Config) audit(op string, changes []Change) {
+	if c.AuditSink == nil || len(changes) == 0 {
+		return
+	}
+	redactedChanges := make([]Change, len(changes))
+	copy(redactedChanges, changes)
+	changes = redactedChanges
+	for i, change := range changes {
+		if !IsSecretSection(strings.Split(change.Key, ".")[0]) {
+			continue
+		}
+		if change.Old != nil {
+			changes[i].Old = Redacted
+		}
+		if change.New != nil {
+			changes[i].New = Redacted
+		}
+	}
+	c.AuditSink.Audit(AuditEntry{
+		Time:     now(),
+		Op:       op,
+		Sections: changedSections(changes),
+		Changes:  changes,
+		Process:  processName(),
+		PID:      os.Getpid(),
+		Tag:      c.AuditTag,
+	})
+}
+
+// normalizeSettings converts the values in settings to the types they
+// would have after being written to and read from the config file.
+func normalizeSettings(settings map[string]interface{}) (map[string]interface{}, error) {
+	tree, err := toml.TreeFromMap(settings)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := tree.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return tomlToMap(buf.Bytes())
+}
+
+// processName returns the name of the executable of this process.
+func processName() string {
+	return filepath.Base(os.Args[0])
+}
@@ -18,11 +18,14 @@ package config
 
 const BatteryKey = "battery"
 
+var BatterySection = TypedSection[Battery]{key: BatteryKey}
+
 func init() {
 	allSections[BatteryKey] = section{
 		key:         BatteryKey,
 		mapToStruct: batteryMapToStruct,
-		validate:    noValidateFunc,
+		validate:    validateBattery,
+		defaults:    DefaultBattery(),
 	}
 }
 
@@ -33,6 +36,10 @@ type Battery struct {
 	FullBattery           uint16 `mapstructure:"full-battery-reading"`
 }
 
+func DefaultBattery() Battery {
+	return Battery{}
+}
+
 func batteryMapToStruct(m map[string]interface{}) (interface{}, error) {
 	var s Battery
 	if err := decodeStructFromMap(&s, m, nil); err != nil {
@@ -40,3 +47,18 @@ func batteryMapToStruct(m map[string]interface{}) (interface{}, error) {
 	}
 	return s, nil
 }
+
+func validateBattery(s interface{}) error {
+	b, ok := s.(Battery)
+	if !ok {
+		return nil
+	}
+	errs := newFieldErrors(BatteryKey)
+	if b.LowBattery != 0 && b.NoBattery > b.LowBattery {
+		errs.add("no-battery-reading", b.NoBattery, "can not be above low-battery-reading")
+	}
+	if b.FullBattery != 0 && b.LowBattery > b.FullBattery {
+		errs.add("low-battery-reading", b.LowBattery, "can not be above full-battery-reading")
+	}
+	return errs.err()
+}
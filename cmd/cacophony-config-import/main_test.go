@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	config "github.com/TheCacophonyProject/go-config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMotionConfigKeys(t *testing.T) {
+	motionType := reflect.TypeOf(motionConfig{})
+	thermalMotionType := reflect.TypeOf(config.ThermalMotion{})
+	require.Equal(t, thermalMotionType.NumField(), motionType.NumField())
+	for i := 0; i < motionType.NumField(); i++ {
+		field := motionType.Field(i)
+		key := field.Tag.Get("mapstructure")
+		require.True(t, strings.HasPrefix(key, config.ThermalMotionKey+"."), key)
+		thermalMotionField, ok := thermalMotionType.FieldByName(field.Name)
+		require.True(t, ok, field.Name)
+		require.Equal(t, config.ThermalMotionKey+"."+thermalMotionField.Tag.Get("mapstructure"), key)
+	}
+}
+
+func TestMotionConfigRoundTrip(t *testing.T) {
+	// Zero values are not imported so every field is set.
+	motion := motionConfig{
+		DynamicThreshold: true,
+		TempThresh:       3000,
+		DeltaThresh:      60,
+		CountThresh:      4,
+		FrameCompareGap:  50,
+		UseOneDiffOnly:   true,
+		TriggerFrames:    3,
+		WarmerOnly:       true,
+		EdgePixels:       2,
+		Verbose:          true,
+	}
+	thermalMotion := importThermalMotion(t, motion)
+
+	motionValue := reflect.ValueOf(motion)
+	thermalMotionValue := reflect.ValueOf(thermalMotion)
+	for i := 0; i < motionValue.NumField(); i++ {
+		name := motionValue.Type().Field(i).Name
+		require.Equal(t,
+			motionValue.Field(i).Interface(),
+			thermalMotionValue.FieldByName(name).Interface(),
+			name)
+	}
+}
+
+func importThermalMotion(t *testing.T, motion motionConfig) config.ThermalMotion {
+	dir, err := ioutil.TempDir("", "cacophony-config-import")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := interfaceToMap(motion)
+	require.NoError(t, err)
+	v := viper.New()
+	v.SetConfigFile(path.Join(dir, config.ConfigFileName))
+	require.NoError(t, v.MergeConfigMap(m))
+	require.NoError(t, v.WriteConfig())
+
+	conf, err := config.New(dir)
+	require.NoError(t, err)
+	conf.AuditSink = nil
+	raw := map[string]interface{}{}
+	require.NoError(t, conf.Unmarshal(config.ThermalMotionKey, &raw))
+	require.Len(t, raw, len(m))
+	// Setting from a map fails on keys that are not in the section struct.
+	require.NoError(t, conf.SetFromMap(config.ThermalMotionKey, raw))
+
+	thermalMotion, err := config.ThermalMotionSection.Load(conf)
+	require.NoError(t, err)
+	return thermalMotion
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
 	"strings"
 
 	config "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/go-config/configdbus"
+	"github.com/TheCacophonyProject/go-config/configsync"
 	"github.com/alexflint/go-arg"
+	"github.com/godbus/dbus/v5"
 )
 
 var version = "<not set>"
@@ -16,7 +22,12 @@ type Args struct {
 	ConfigDir string   `arg:"-c,--config" help:"path to configuration directory"`
 	Write     bool     `arg:"-w,--write" help:"write to config file"`
 	Read      bool     `arg:"-r,--read" help:"read from the config file"`
-	Input     []string `arg:"positional"`
+	Origin    bool     `arg:"--origin" help:"with --read, show every field and the file its value comes from"`
+	Env       bool     `arg:"--env" help:"with --read, apply overrides from CACOPHONY_<SECTION>_<FIELD> environment variables"`
+	Unset     bool     `arg:"--unset" help:"remove fields, given as section.field, from the config file so their defaults are used"`
+	Reset     bool     `arg:"--reset" help:"reset sections, or fields given as section.field, to their defaults"`
+	DryRun    bool     `arg:"--dry-run" help:"show what a command would change without changing the config file"`
+	Input     []string `arg:"positional" help:"a command (migrate, history, rollback [n], apply [sections], serve-dbus or sync), sections to read, or settings to write such as section.field=value, section.list+=value or section.list-=index"`
 }
 
 func (Args) Version() string {
@@ -41,22 +52,227 @@ func runMain() error {
 	log.SetFlags(0)
 	log.Printf("running version: %s", version)
 
+	if len(args.Input) > 0 {
+		if command, ok := commands[args.Input[0]]; ok {
+			return command(&args)
+		}
+	}
 	if args.Write {
 		return writeNewSettings(&args)
 	}
 	if args.Read {
 		return readConfig(&args)
 	}
+	if args.Unset || args.Reset {
+		return resetSettings(&args)
+	}
 	return errors.New("no valid arguments given")
 }
 
+// commands are run when they are given as the first positional argument.
+var commands = map[string]func(*Args) error{
+	"migrate":    runMigrate,
+	"history":    runHistory,
+	"rollback":   runRollback,
+	"apply":      runApply,
+	"serve-dbus": runServeDbus,
+	"sync":       runSync,
+}
+
+func runMigrate(args *Args) error {
+	before, after, err := config.Migrate(args.ConfigDir, args.DryRun)
+	if err != nil {
+		return err
+	}
+	changes := config.DiffSettings(before, after)
+	if len(changes) == 0 {
+		log.Printf("config is at schema version %d, nothing to migrate", config.SchemaVersion())
+		return nil
+	}
+	if args.DryRun {
+		log.Printf("migrating to schema version %d would make these changes:", config.SchemaVersion())
+	} else {
+		log.Printf("migrated to schema version %d with these changes:", config.SchemaVersion())
+	}
+	for _, change := range changes {
+		log.Println(formatMigrateChange(change))
+	}
+	return nil
+}
+
+// formatMigrateChange is formatChange with secrets removed from the config
+// file shown as moved to the secrets file.
+func formatMigrateChange(change config.Change) string {
+	if change.New == nil && config.IsSecretSection(strings.Split(change.Key, ".")[0]) {
+		return fmt.Sprintf("> %s moved to %s", change.Key, config.SecretsFileName)
+	}
+	return formatChange(change)
+}
+
+func formatChange(change config.Change) string {
+	switch {
+	case change.Old == nil:
+		return fmt.Sprintf("+ %s = %v", change.Key, change.New)
+	case change.New == nil:
+		return fmt.Sprintf("- %s = %v", change.Key, change.Old)
+	default:
+		return fmt.Sprintf("~ %s = %v -> %v", change.Key, change.Old, change.New)
+	}
+}
+
+func runHistory(args *Args) error {
+	conf, err := newConfig(args.ConfigDir, true)
+	if err != nil {
+		return err
+	}
+	entries, err := conf.History()
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		log.Printf("%d: %s by %s (pid %d), sections: %s",
+			i+1, entry.Time.Format(config.TimeFormat), entry.Process, entry.PID, strings.Join(entry.Sections, ", "))
+		for _, change := range entry.Changes {
+			log.Printf("    %s", formatChange(change))
+		}
+	}
+	return nil
+}
+
+// runRollback undoes the last n writes, given as the argument after the
+// command. The last write is undone if n is not given.
+func runRollback(args *Args) error {
+	n := 1
+	if len(args.Input) > 2 {
+		return errors.New("rollback takes at most one argument, the number of writes to undo")
+	}
+	if len(args.Input) == 2 {
+		var err error
+		if n, err = strconv.Atoi(args.Input[1]); err != nil {
+			return fmt.Errorf("'%s' is not a number of writes to undo", args.Input[1])
+		}
+	}
+	conf, err := newConfig(args.ConfigDir, false)
+	if err != nil {
+		return err
+	}
+	if err := conf.Rollback(n); err != nil {
+		return err
+	}
+	log.Printf("rolled back the last %d writes", n)
+	return nil
+}
+
+// runApply restarts the systemd units that use the sections given after the
+// command, or the sections changed by the last write if none are given.
+func runApply(args *Args) error {
+	conf, err := newConfig(args.ConfigDir, true)
+	if err != nil {
+		return err
+	}
+	sections := args.Input[1:]
+	if len(sections) == 0 {
+		entries, err := conf.History()
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return errors.New("no sections given and there are no writes in the history")
+		}
+		sections = entries[0].Sections
+	}
+	if args.DryRun {
+		units, err := conf.UnitsForSections(sections)
+		if err != nil {
+			return err
+		}
+		log.Printf("would restart units using %s: %s", strings.Join(sections, ", "), strings.Join(units, ", "))
+		return nil
+	}
+	restarter, err := config.NewSystemdRestarter()
+	if err != nil {
+		return err
+	}
+	conf.Restarter = restarter
+	units, err := conf.RestartUnits(sections)
+	if err != nil {
+		return err
+	}
+	log.Printf("restarted units using %s: %s", strings.Join(sections, ", "), strings.Join(units, ", "))
+	return nil
+}
+
+// runServeDbus exports the config on the system bus until the process is
+// stopped.
+func runServeDbus(args *Args) error {
+	conf, err := newConfig(args.ConfigDir, false)
+	if err != nil {
+		return err
+	}
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	if err := configdbus.Export(context.Background(), conn, conf); err != nil {
+		return err
+	}
+	log.Printf("exported config on D-Bus as '%s'", configdbus.DbusName)
+	select {}
+}
+
+// syncQueueFile is where runSync keeps the changes waiting to be pushed.
+var syncQueueFile = configsync.DefaultQueueFile
+
+// runSync pushes local changes to the server and pulls the settings from it.
+func runSync(args *Args) error {
+	conf, err := newConfig(args.ConfigDir, false)
+	if err != nil {
+		return err
+	}
+	conf.AuditTag = "sync"
+	result, err := configsync.New(conf, syncQueueFile).Sync(context.Background())
+	if result != nil {
+		log.Printf("pushed: %s, pulled: %s", strings.Join(result.Pushed, ", "), strings.Join(result.Pulled, ", "))
+		for section, rejectErr := range result.Rejected {
+			log.Printf("rejected '%s' from the server: %v", section, rejectErr)
+		}
+	}
+	return err
+}
+
+func newConfig(dir string, readOnly bool) (*config.Config, error) {
+	newFunc := config.New
+	if readOnly {
+		newFunc = config.NewReadOnly
+	}
+	conf, err := newFunc(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range conf.Warnings() {
+		log.Printf("warning: %v", warning)
+	}
+	return conf, nil
+}
+
 func readConfig(args *Args) error {
-	conf, err := config.New(args.ConfigDir)
+	conf, err := newConfig(args.ConfigDir, true)
 	if err != nil {
 		return err
 	}
+	if args.Env {
+		if err := conf.BindEnv(); err != nil {
+			return err
+		}
+	}
 
 	for _, section := range args.Input {
+		if args.Origin {
+			if err := logOrigins(conf, section); err != nil {
+				return err
+			}
+			continue
+		}
 		var m map[string]interface{}
 		if err := conf.Unmarshal(section, &m); err != nil {
 			return err
@@ -66,10 +282,42 @@ func readConfig(args *Args) error {
 	return nil
 }
 
+// logOrigins logs every field of the section with the file its value comes
+// from.
+func logOrigins(conf *config.Config, section string) error {
+	values, err := conf.SectionValues(section)
+	if err != nil {
+		return err
+	}
+	fields := make([]string, 0, len(values))
+	for field := range values {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		origin, err := conf.Origin(section, field)
+		if err != nil {
+			return err
+		}
+		log.Printf("%s.%s = %v (from %s)", section, field, values[field], origin)
+	}
+	return nil
+}
+
+type operation int
+
+const (
+	opSet operation = iota
+	opAppend
+	opRemove
+	opReset
+)
+
 type setting struct {
 	section string
 	field   string
 	value   string
+	op      operation
 }
 
 func writeNewSettings(args *Args) error {
@@ -79,20 +327,23 @@ func writeNewSettings(args *Args) error {
 	}
 	log.Printf("new settings: %+v", settings)
 
-	conf, err := config.New(args.ConfigDir)
+	conf, err := newConfig(args.ConfigDir, false)
 	if err != nil {
 		return err
 	}
-	conf.AutoWrite = false // Only write if there were no errors in writing all the settings
 
+	// Only write if there were no errors in writing all the settings
 	sections := map[string]struct{}{}
-	for _, s := range settings {
-		if err := conf.SetField(s.section, s.field, s.value); err != nil {
-			return err
+	err = conf.Transaction(func(tx *config.Tx) error {
+		for _, s := range settings {
+			if err := applySetting(tx, s); err != nil {
+				return err
+			}
+			sections[s.section] = struct{}{}
 		}
-		sections[s.section] = struct{}{}
-	}
-	if err := conf.Write(); err != nil {
+		return nil
+	})
+	if err != nil {
 		return err
 	}
 
@@ -107,6 +358,47 @@ func writeNewSettings(args *Args) error {
 	return nil
 }
 
+func resetSettings(args *Args) error {
+	settings, err := getResetSettings(args.Input, args.Unset)
+	if err != nil {
+		return err
+	}
+	log.Printf("settings to reset: %+v", settings)
+
+	conf, err := newConfig(args.ConfigDir, false)
+	if err != nil {
+		return err
+	}
+	return conf.Transaction(func(tx *config.Tx) error {
+		for _, s := range settings {
+			if err := applySetting(tx, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func applySetting(tx *config.Tx, s setting) error {
+	switch s.op {
+	case opReset:
+		if s.field == "" {
+			return tx.ResetToDefault(s.section)
+		}
+		return tx.UnsetField(s.section, s.field)
+	case opAppend:
+		return tx.SetField(s.section, s.field+"[]", s.value)
+	case opRemove:
+		return tx.RemoveField(s.section, fmt.Sprintf("%s[%s]", s.field, s.value))
+	default:
+		return tx.SetField(s.section, s.field, s.value)
+	}
+}
+
+// getNewSettings parses settings in the form "section.field=value". The
+// field can be a path to a nested field such as "modemd.modems[1].net-dev".
+// "section.list+=value" appends to a list and "section.list-=index" removes
+// the element at the index from a list.
 func getNewSettings(args []string) ([]setting, error) {
 	settings := []setting{}
 	for _, arg := range args {
@@ -117,15 +409,49 @@ func getNewSettings(args []string) ([]setting, error) {
 		key := spl[0]
 		val := spl[1]
 
-		spl = strings.Split(key, ".")
-		if len(spl) != 2 {
-			return nil, fmt.Errorf("'%s' should contain one '.' Nested fields are not supported yet", arg)
+		op := opSet
+		if strings.HasSuffix(key, "+") {
+			op = opAppend
+			key = strings.TrimSuffix(key, "+")
+		} else if strings.HasSuffix(key, "-") {
+			op = opRemove
+			key = strings.TrimSuffix(key, "-")
+			if _, err := strconv.Atoi(val); err != nil {
+				return nil, fmt.Errorf("'%s' should give the index of the element to remove", arg)
+			}
+		}
+
+		spl = strings.SplitN(key, ".", 2)
+		if len(spl) != 2 || spl[0] == "" || spl[1] == "" {
+			return nil, fmt.Errorf("'%s' should be in the form 'section.field=value'", arg)
 		}
 		settings = append(settings, setting{
 			section: spl[0],
 			field:   spl[1],
 			value:   val,
+			op:      op,
 		})
 	}
 	return settings, nil
 }
+
+// getResetSettings parses sections and fields to reset in the form
+// "section" or "section.field". If fieldRequired is true every argument
+// must give a field.
+func getResetSettings(args []string, fieldRequired bool) ([]setting, error) {
+	settings := []setting{}
+	for _, arg := range args {
+		spl := strings.SplitN(arg, ".", 2)
+		if spl[0] == "" || (len(spl) == 2 && spl[1] == "") {
+			return nil, fmt.Errorf("'%s' should be in the form 'section' or 'section.field'", arg)
+		}
+		s := setting{section: spl[0], op: opReset}
+		if len(spl) == 2 {
+			s.field = spl[1]
+		} else if fieldRequired {
+			return nil, fmt.Errorf("'%s' should be in the form 'section.field'", arg)
+		}
+		settings = append(settings, s)
+	}
+	return settings, nil
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
 	"testing"
 
+	config "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/go-config/configtest"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
 )
 
@@ -17,6 +24,60 @@ func TestParseArgs(t *testing.T) {
 	require.Equal(t, expected, sections)
 }
 
+func TestParseNestedArgs(t *testing.T) {
+	args := []string{"modemd.modems[1].net-dev=eth2", "test-hosts.urls+=9.9.9.9", "modemd.modems-=0"}
+	expected := []setting{
+		setting{section: "modemd", field: "modems[1].net-dev", value: "eth2"},
+		setting{section: "test-hosts", field: "urls", value: "9.9.9.9", op: opAppend},
+		setting{section: "modemd", field: "modems", value: "0", op: opRemove},
+	}
+	sections, err := getNewSettings(args)
+	require.NoError(t, err)
+	require.Equal(t, expected, sections)
+}
+
+func TestParseResetArgs(t *testing.T) {
+	expected := []setting{
+		setting{section: "windows", field: "power-on", op: opReset},
+		setting{section: "thermal-motion", op: opReset},
+	}
+	settings, err := getResetSettings([]string{"windows.power-on", "thermal-motion"}, false)
+	require.NoError(t, err)
+	require.Equal(t, expected, settings)
+
+	_, err = getResetSettings([]string{"thermal-motion"}, true)
+	require.Error(t, err)
+	_, err = getResetSettings([]string{"windows."}, false)
+	require.Error(t, err)
+	_, err = getResetSettings([]string{".power-on"}, false)
+	require.Error(t, err)
+}
+
+func TestFormatChange(t *testing.T) {
+	before := map[string]interface{}{
+		"thermal-motion": map[string]interface{}{"min-secs": true, "temp-thresh": 2900},
+	}
+	after := map[string]interface{}{
+		"schema-version": 1,
+		"thermal-motion": map[string]interface{}{"dynamic-threshold": true, "temp-thresh": 3000},
+	}
+	expected := []string{
+		"+ schema-version = 1",
+		"+ thermal-motion.dynamic-threshold = true",
+		"- thermal-motion.min-secs = true",
+		"~ thermal-motion.temp-thresh = 2900 -> 3000",
+	}
+	lines := []string{}
+	for _, change := range config.DiffSettings(before, after) {
+		lines = append(lines, formatChange(change))
+	}
+	require.Equal(t, expected, lines)
+
+	change := config.Change{Key: "secrets.device-password", Old: config.Redacted}
+	require.Equal(t, "> secrets.device-password moved to secrets.toml", formatMigrateChange(change))
+	require.Equal(t, "- secrets.device-password = <redacted>", formatChange(change))
+}
+
 func TestBadArgs(t *testing.T) {
 	_, err := getNewSettings([]string{"cat.foobar"})
 	require.Error(t, err)
@@ -27,6 +88,45 @@ func TestBadArgs(t *testing.T) {
 	_, err = getNewSettings([]string{"cat.dog=foo=bar"})
 	require.Error(t, err)
 
-	_, err = getNewSettings([]string{"cat.dog.foo=bar"})
+	_, err = getNewSettings([]string{".foo=bar"})
+	require.Error(t, err)
+
+	_, err = getNewSettings([]string{"cat.=bar"})
+	require.Error(t, err)
+
+	_, err = getNewSettings([]string{"cat.dog-=bar"})
 	require.Error(t, err)
 }
+
+func TestSyncCommand(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFs(fs)
+	t.Cleanup(func() { config.SetFs(afero.NewOsFs()) })
+	configFile := path.Join(config.DefaultConfigDir, config.ConfigFileName)
+	lockFileFunc, cleanup := configtest.WriteConfigFromBytes(t, nil, configFile, fs)
+	t.Cleanup(cleanup)
+	config.SetLockFilePath(lockFileFunc)
+	syncQueueFile = filepath.Join(t.TempDir(), "sync.json")
+
+	pushed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/authenticate_device":
+			w.Write([]byte(`{"token": "JWT token"}`))
+		case r.Method == http.MethodPost:
+			pushed = true
+		default:
+			w.Write([]byte(`{"settings": {}}`))
+		}
+	}))
+	defer server.Close()
+	conf, err := config.New(config.DefaultConfigDir)
+	require.NoError(t, err)
+	require.NoError(t, conf.Set(config.DeviceKey, config.Device{ID: 1, Server: server.URL}))
+	require.NoError(t, conf.Set(config.SecretsKey, config.Secrets{DevicePassword: "pass"}))
+	require.NoError(t, conf.SetField(config.WindowsKey, "power-on", "06:00"))
+
+	args := Args{ConfigDir: config.DefaultConfigDir, Input: []string{"sync"}}
+	require.NoError(t, commands[args.Input[0]](&args))
+	require.True(t, pushed)
+}
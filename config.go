@@ -18,15 +18,12 @@ package config
 
 import (
 	"bytes"
-	"context"
-	"errors"
 	"fmt"
 	"path"
 	"reflect"
 	"strings"
 	"time"
 
-	"github.com/gofrs/flock"
 	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/afero"
 	"github.com/spf13/viper"
@@ -36,15 +33,27 @@ import (
 
 type Config struct {
 	v                *viper.Viper
-	fileLock         *flock.Flock
-	accessedSections map[string]struct{} //TODO record each section accessed for restarting service purpose
+	fileLock         *fileLock
+	secretsLock      *fileLock // Lock on the secrets file.
+	unitsLock        *fileLock // Lock on the units file.
+	secretsErr       error     // Why the secrets file couldn't be read.
+	accessedSections map[string]struct{}
+	warnings         []error
+	lowerLayers      []layer // Layers config.toml is merged over.
+	upperLayers      []layer // Layers merged over config.toml.
+	envLayers        []layer // Environment overrides merged over all the files.
+	layerWarnings    []error
+	unwritten        map[string]interface{} // Settings from before the changes that haven't been written.
 	AutoWrite        bool
+	AuditSink        AuditSink     // Set to nil to not audit changes.
+	AuditTag         string        // Added to audit entries to identify the caller.
+	Restarter        UnitRestarter // If set, units using changed sections are restarted on writes.
+	RecordAccess     bool          // Record the sections read so the unit is restarted when they change.
 }
 
 const (
 	DefaultConfigDir = "/etc/cacophony"
 	ConfigFileName   = "config.toml"
-	lockRetryDelay   = 678 * time.Millisecond
 	TimeFormat       = time.RFC3339
 )
 
@@ -52,6 +61,11 @@ type section struct {
 	key         string
 	mapToStruct func(map[string]interface{}) (interface{}, error)
 	validate    func(interface{}) error
+	decodeHook  interface{}
+	defaults    interface{}
+	docs        map[string]string
+	secret      bool              // Values are redacted when shown and kept in the secrets file.
+	legacyKeys  map[string]string // old key -> new key
 }
 
 type decodeHookFunc func(reflect.Type, reflect.Type, interface{}) (interface{}, error)
@@ -66,145 +80,352 @@ var lockFilePath = func(configFile string) string {
 	return configFile + ".lock"
 }
 var lockTimeout = 10 * time.Second
+var lockRetryDelay = 678 * time.Millisecond
 var mapStrInterfaceType = reflect.TypeOf(map[string]interface{}{})
+var timeType = reflect.TypeOf(time.Time{})
 
 // New created a new config and loads files from the given directory
 func New(dir string) (*Config, error) {
-	// TODO Take service name and restart service if config changes
+	return newConfig(dir, false)
+}
+
+// NewReadOnly is the same as New but the config can't be changed. If the
+// lock file can't be opened, for example when the user can't write to the
+// config directory, the config is read without a lock.
+func NewReadOnly(dir string) (*Config, error) {
+	return newConfig(dir, true)
+}
+
+func newConfig(dir string, readOnly bool) (*Config, error) {
 	configFile := path.Join(dir, ConfigFileName)
 	c := &Config{
-		v:         viper.New(),
-		fileLock:  flock.New(lockFilePath(configFile)),
-		AutoWrite: true,
+		v:                viper.New(),
+		fileLock:         newFileLock(lockFilePath(configFile), readOnly),
+		secretsLock:      newFileLock(lockFilePath(secretsFilePath(configFile)), readOnly),
+		unitsLock:        newFileLock(lockFilePath(unitsFilePath(configFile)), readOnly),
+		accessedSections: map[string]struct{}{},
+		AutoWrite:        !readOnly,
+		RecordAccess:     true,
+	}
+	if !readOnly {
+		c.AuditSink = NewFileAuditSink(DefaultAuditLogFile)
 	}
 	c.v.SetFs(fs)
 	c.v.SetConfigFile(configFile)
-	if err := c.getFileLock(); err != nil {
+	if err := c.read(); err != nil {
 		return nil, err
 	}
-	defer c.fileLock.Unlock()
+	return c, nil
+}
+
+// read reads in the config file and the other layers, runs any pending
+// migrations on the config file and then makes a last known good copy of it
+// if there isn't one.
+func (c *Config) read() error {
+	if err := c.readFile(); err != nil {
+		return err
+	}
+	if err := c.migrate(); err != nil {
+		return err
+	}
+	c.seedGoodFile()
+	return nil
+}
+
+// readFile reads in the config file under the shared lock. If the file
+// can't be parsed it is recovered from the last known good copy.
+func (c *Config) readFile() error {
+	err := c.readShared()
+	if _, ok := err.(viper.ConfigParseError); !ok {
+		return err
+	}
+	if c.fileLock.readOnly {
+		return c.recoverConfig(err)
+	}
+	if err := c.fileLock.lock(); err != nil {
+		return err
+	}
+	defer c.fileLock.unlock()
+	// Another process might have fixed the file since the shared lock was released.
+	err = c.readInConfig()
+	if _, ok := err.(viper.ConfigParseError); !ok {
+		return err
+	}
+	return c.recoverConfig(err)
+}
+
+func (c *Config) readShared() error {
+	if err := c.fileLock.rlock(); err != nil {
+		return err
+	}
+	defer c.fileLock.unlock()
+	return c.readInConfig()
+}
+
+// readInConfig reads in the config file, the secrets file and the other
+// layers. Legacy keys in the sections are renamed so they are read from and
+// written to their new keys.
+func (c *Config) readInConfig() error {
 	if err := c.v.ReadInConfig(); err != nil {
-		return nil, err
+		return err
 	}
-	return c, nil
+	if err := c.readSecrets(); err != nil {
+		return err
+	}
+	c.loadLayers()
+	settings := c.v.AllSettings()
+	if !renameLegacyKeys(settings) {
+		return nil
+	}
+	return c.resetSettings(settings)
 }
 
+// Unmarshal decodes the section into raw. If raw is a pointer to the struct
+// of the section and the section is in the config file, it is validated
+// after decoding.
+// If raw is a pointer to the zero value of the section struct it is set to
+// the defaults of the section first.
 func (c *Config) Unmarshal(key string, raw interface{}) error {
-	return c.v.UnmarshalKey(key, raw)
+	return c.unmarshal(key, raw, true)
+}
+
+// unmarshal is Unmarshal with the choice of recording the section as
+// accessed.
+func (c *Config) unmarshal(key string, raw interface{}, record bool) error {
+	if c.secretsErr != nil && IsSecretSection(key) {
+		return c.secretsErr
+	}
+	v := c.view()
+	fillDefaults(key, raw)
+	clearSlices(raw, v.GetStringMap(key))
+	if err := v.UnmarshalKey(key, raw, readDecodeHook(key)); err != nil {
+		return err
+	}
+	if !checkIfSectionKey(key) {
+		return nil
+	}
+	if record {
+		c.recordAccess(key)
+	}
+	if !v.IsSet(key) {
+		return nil
+	}
+	return validateSection(key, raw)
 }
 
 // Set can only update one section at a time.
 func (c *Config) Set(key string, value interface{}) error {
+	return c.mutate("Set", c.AutoWrite, func() error {
+		return c.setAt(key, value, now(), false)
+	})
+}
+
+// StrictSet will only update the section if the given time is after the
+// "updated" field of the section. The "updated" field is then set to the
+// given time. A *StaleUpdateError is returned if the update was rejected.
+func (c *Config) StrictSet(key string, value interface{}, updated time.Time) error {
+	return c.mutate("StrictSet", c.AutoWrite, func() error {
+		return c.setAt(key, value, updated, true)
+	})
+}
+
+func (c *Config) setAt(key string, value interface{}, updated time.Time, strict bool) error {
 	if !checkIfSectionKey(key) {
 		return notSectionKeyError(key)
 	}
-	if err := c.getFileLock(); err != nil {
-		return err
+	if strict {
+		if err := c.checkUpdated(key, updated); err != nil {
+			return err
+		}
 	}
-	defer c.fileLock.Unlock()
-	if err := c.Update(); err != nil {
+	if err := validateValue(key, value); err != nil {
 		return err
 	}
 	kind := reflect.ValueOf(value).Kind()
 	if kind == reflect.Struct || kind == reflect.Ptr {
-		return c.setStruct(key, value)
-	}
-	c.set(key, value)
-	if c.AutoWrite {
-		return c.v.WriteConfig()
+		m, err := interfaceToMap(value)
+		if err != nil {
+			return err
+		}
+		value = m
 	}
+	c.set(key, value, updated)
 	return nil
 }
 
 // SetFromMap can only update one section at a time.
 func (c *Config) SetFromMap(sectionKey string, newConfig map[string]interface{}) error {
+	return c.mutate("SetFromMap", c.AutoWrite, func() error {
+		return c.setFromMapAt(sectionKey, newConfig, now(), false)
+	})
+}
+
+// StrictSetFromMap is the map equivalent of StrictSet.
+func (c *Config) StrictSetFromMap(sectionKey string, newConfig map[string]interface{}, updated time.Time) error {
+	return c.mutate("StrictSetFromMap", c.AutoWrite, func() error {
+		return c.setFromMapAt(sectionKey, newConfig, updated, true)
+	})
+}
+
+func (c *Config) setFromMapAt(sectionKey string, newConfig map[string]interface{}, updated time.Time, strict bool) error {
 	if !checkIfSectionKey(sectionKey) {
 		return notSectionKeyError(sectionKey)
 	}
-	if err := c.getFileLock(); err != nil {
-		return err
-	}
-	defer c.fileLock.Unlock()
-	if err := c.Update(); err != nil {
-		return err
-	}
-
 	section := allSections[sectionKey]
 	newStruct, err := section.mapToStruct(newConfig)
 	if err != nil {
 		return err
 	}
+	return c.setAt(sectionKey, newStruct, updated, strict)
+}
 
-	return c.Set(sectionKey, newStruct)
+// SetField sets the field at fieldPath in the section from a string.
+// Nested fields and list elements can be set with a path such as
+// "modems[1].net-dev", and "urls[]" will append to a list.
+func (c *Config) SetField(sectionKey, fieldPath, value string) error {
+	return c.mutate("SetField", c.AutoWrite, func() error {
+		return c.setField(sectionKey, fieldPath, value)
+	})
 }
 
-func (c *Config) SetField(sectionKey, valueKey, value string) error {
-	if !checkIfSectionKey(sectionKey) {
-		return notSectionKeyError(sectionKey)
+// Update reads in the latest config. Reading in the config would drop the
+// changes that haven't been written, so while there are any it does nothing
+// until they are written with Write.
+func (c *Config) Update() error {
+	if c.unwritten != nil {
+		return nil
 	}
-
-	section := allSections[sectionKey]
-	s := map[string]interface{}{}
-	c.Unmarshal(section.key, &s)
-	s[valueKey] = value
-	delete(s, "updated")
-	return c.SetFromMap(sectionKey, s)
+	return c.readShared()
 }
 
-func (c *Config) Update() error {
-	if err := c.getFileLock(); err != nil {
+// mutate runs f while holding the file lock, after reading in the latest
+// config unless there are changes that haven't been written yet. If write
+// is true the config is written after f. The settings are rolled back if f
+// or the write fails. Once written, the changes are sent to the audit sink
+// with op as the operation, changes that aren't written yet are audited by
+// Write.
+// Once the config file has been written the change has been made, so errors
+// keeping records of it, such as the history, the last known good copy and
+// the audit log, are ignored. Not being able to record a change shouldn't
+// stop it.
+func (c *Config) mutate(op string, write bool, f func() error) error {
+	if err := c.fileLock.lock(); err != nil {
 		return err
 	}
-	defer c.fileLock.Unlock()
-	return c.v.ReadInConfig()
+	defer c.fileLock.unlock()
+	if c.unwritten == nil {
+		if err := c.readInConfig(); err != nil {
+			return err
+		}
+	}
+	settings := c.v.AllSettings()
+	err := f()
+	if err == nil && write {
+		err = c.writeConfig()
+	}
+	if err != nil {
+		if rollbackErr := c.resetSettings(settings); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+	if !write {
+		if c.unwritten == nil {
+			c.unwritten = settings
+		}
+		return nil
+	}
+	if c.unwritten != nil {
+		settings, c.unwritten = c.unwritten, nil
+	}
+	c.afterMutate(op, settings)
+	return nil
+}
+
+// afterMutate audits the changes from the old settings that have been
+// written and restarts the units using the changed sections. Errors are
+// ignored, see mutate.
+func (c *Config) afterMutate(op string, old map[string]interface{}) {
+	restart := c.Restarter != nil
+	if c.AuditSink == nil && !restart {
+		return
+	}
+	changes, err := settingsChanges(old, c.v.AllSettings())
+	if err != nil || len(changes) == 0 {
+		return
+	}
+	c.audit(op, changes)
+	if restart {
+		c.RestartUnits(changedSections(changes))
+	}
+}
+
+// Updated returns the time the section was last updated, or the zero time
+// if it hasn't been.
+func (c *Config) Updated(sectionKey string) time.Time {
+	return c.v.GetTime(sectionKey + ".updated")
+}
+
+// StaleUpdateError is returned when a strict update is not newer than the
+// last update of the section.
+type StaleUpdateError struct {
+	Section string
+	Updated time.Time
+	Given   time.Time
 }
 
-// TODO Only update if given time is after the "udpate" field of the section updating and set "update" field to given time if updating
-/*
-func (c *Config) StrictSet(key string, value interface{}, time time.Time) error {
+func (e *StaleUpdateError) Error() string {
+	return fmt.Sprintf("update of '%s' from %s is not after the last update at %s",
+		e.Section, e.Given.Format(TimeFormat), e.Updated.Format(TimeFormat))
+}
+
+// checkUpdated returns a *StaleUpdateError if the given time is not after
+// the "updated" field of the section. Times are compared to the second as
+// that is all that is kept in the config file.
+func (c *Config) checkUpdated(sectionKey string, updated time.Time) error {
+	last := c.Updated(sectionKey)
+	if !updated.Truncate(time.Second).After(last.Truncate(time.Second)) {
+		return &StaleUpdateError{
+			Section: sectionKey,
+			Updated: last,
+			Given:   updated,
+		}
+	}
 	return nil
 }
-*/
 
 func (c *Config) Unset(key string) error {
+	return c.mutate("Unset", c.AutoWrite, func() error {
+		return c.unset(key)
+	})
+}
+
+func (c *Config) unset(key string) error {
 	configMap := c.v.AllSettings()
 	delete(configMap, key)
-	tomlTree, err := toml.TreeFromMap(configMap)
-	if err != nil {
-		return err
-	}
-	configFile := c.v.ConfigFileUsed()
-	// Need a new viper instance to clear old settings
-	c.v = viper.New()
-	c.v.SetFs(fs)
-	c.v.SetConfigFile(configFile)
-	var buf bytes.Buffer
-	_, err = tomlTree.WriteTo(&buf)
-	if err != nil {
-		return err
-	}
-	if err := c.v.ReadConfig(bytes.NewReader(buf.Bytes())); err != nil {
+	if err := c.resetSettings(configMap); err != nil {
 		return err
 	}
 	c.v.Set(key+".updated", now())
-	if c.AutoWrite {
-		return c.v.WriteConfig()
-	}
 	return nil
 }
 
-var errNoFileLock = errors.New("failed to get lock on file")
-
-func (c *Config) getFileLock() error {
-	lockCtx, cancel := context.WithTimeout(context.Background(), lockTimeout)
-	defer cancel()
-	locked, err := c.fileLock.TryLockContext(lockCtx, lockRetryDelay)
+// resetSettings replaces all the settings with the given settings.
+func (c *Config) resetSettings(settings map[string]interface{}) error {
+	tomlTree, err := toml.TreeFromMap(settings)
 	if err != nil {
 		return err
-	} else if !locked {
-		return errNoFileLock
 	}
-	return nil
+	var buf bytes.Buffer
+	if _, err := tomlTree.WriteTo(&buf); err != nil {
+		return err
+	}
+	configFile := c.v.ConfigFileUsed()
+	// Need a new viper instance to clear old settings
+	c.v = viper.New()
+	c.v.SetFs(fs)
+	c.v.SetConfigFile(configFile)
+	return c.v.ReadConfig(bytes.NewReader(buf.Bytes()))
 }
 
 func interfaceToMap(value interface{}) (m map[string]interface{}, err error) {
@@ -221,22 +442,22 @@ func interfaceToMap(value interface{}) (m map[string]interface{}, err error) {
 	return
 }
 
-func (c *Config) setStruct(key string, value interface{}) error {
-	m, err := interfaceToMap(value)
-	if err != nil {
+func (c *Config) Write() error {
+	if err := c.fileLock.lock(); err != nil {
 		return err
 	}
-	c.set(key, m)
-	if c.AutoWrite {
-		return c.v.WriteConfig()
+	defer c.fileLock.unlock()
+	if err := c.writeConfig(); err != nil {
+		return err
+	}
+	if c.unwritten != nil {
+		old := c.unwritten
+		c.unwritten = nil
+		c.afterMutate("Write", old)
 	}
 	return nil
 }
 
-func (c *Config) Write() error {
-	return c.v.WriteConfig()
-}
-
 func notSectionKeyError(key string) error {
 	return fmt.Errorf("'%s' is not a key for a section", key)
 }
@@ -246,13 +467,13 @@ func checkIfSectionKey(key string) bool {
 	return ok
 }
 
-func (c *Config) set(key string, value interface{}) {
+func (c *Config) set(key string, value interface{}, updated time.Time) {
 	c.v.Set(key, value)
-	c.v.Set(strings.Split(key, ".")[0]+".updated", now())
+	c.v.Set(strings.Split(key, ".")[0]+".updated", updated)
 }
 
 func (c *Config) Get(key string) interface{} {
-	return c.v.Get(key)
+	return c.view().Get(key)
 }
 
 func SetFs(f afero.Fs) {
@@ -280,6 +501,21 @@ func decodeStructFromMap(s interface{}, m map[string]interface{}, decodeHook int
 	return decoder.Decode(m)
 }
 
+// readDecodeHook returns the decode hook used when reading the section from
+// viper, which is the hook of the section followed by the ones viper uses by
+// default.
+func readDecodeHook(key string) viper.DecoderConfigOption {
+	hooks := []mapstructure.DecodeHookFunc{}
+	if hook := allSections[key].decodeHook; hook != nil {
+		hooks = append(hooks, hook)
+	}
+	hooks = append(hooks,
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+	)
+	return viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(hooks...))
+}
+
 func stringToDuration(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
 	if t != reflect.TypeOf(time.Second) || f.Kind() != reflect.String {
 		return data, nil
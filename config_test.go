@@ -2,9 +2,15 @@ package config
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"log"
 	"math/rand"
+	"os"
 	"path"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -21,6 +27,50 @@ const (
 	testTomlFileDir     = "/"
 )
 
+const customKey = "custom"
+
+type custom struct {
+	Name     string        `mapstructure:"name"`
+	Interval time.Duration `mapstructure:"interval"`
+	Count    int           `mapstructure:"count"`
+}
+
+func init() {
+	err := RegisterSection(customKey, custom{Name: "default", Interval: time.Minute},
+		WithValidator(func(s interface{}) error {
+			errs := newFieldErrors(customKey)
+			if c := s.(custom); c.Count < 0 {
+				errs.add("count", c.Count, "can not be negative")
+			}
+			return errs.err()
+		}),
+		WithFieldDocs(map[string]string{"name": "name of the thing"}))
+	if err != nil {
+		panic(err)
+	}
+}
+
+const hookedKey = "hooked"
+
+type hooked struct {
+	Level int `mapstructure:"level"`
+}
+
+// HookedSection has a decode hook that reads "high" as a level of 10.
+var HookedSection = func() TypedSection[hooked] {
+	s, err := RegisterTypedSection(hookedKey, hooked{}, WithDecodeHook(
+		func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+			if f.Kind() == reflect.String && t.Kind() == reflect.Int && data == "high" {
+				return 10, nil
+			}
+			return data, nil
+		}))
+	if err != nil {
+		panic(err)
+	}
+	return s
+}()
+
 func printConfigFile(dir string) {
 	filePath := path.Join(dir, ConfigFileName)
 	b, err := afero.ReadFile(fs, filePath)
@@ -184,172 +234,1587 @@ func TestClear(t *testing.T) {
 	require.Equal(t, w, w2)
 }
 
-func TestFileLock(t *testing.T) {
-	defer newFs(t, "")()
-	lockTimeout = time.Millisecond * 100
-
+func TestAtomicWrite(t *testing.T) {
+	defer newFs(t, "./test-files/test.toml")()
+	configFile := path.Join(DefaultConfigDir, ConfigFileName)
+	require.NoError(t, fs.Chmod(configFile, 0640))
 	conf, err := New(DefaultConfigDir)
 	require.NoError(t, err)
-	conf2, err := New(DefaultConfigDir)
+
+	require.NoError(t, conf.Set(DeviceKey, randomDevice()))
+	info, err := fs.Stat(configFile)
 	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	requireNoTempFiles(t)
 
-	require.NoError(t, conf.getFileLock())
-	require.Equal(t, context.DeadlineExceeded, conf2.getFileLock())
-	conf.fileLock.Unlock()
-	require.NoError(t, conf2.getFileLock())
+	before, err := afero.ReadFile(fs, configFile)
+	require.NoError(t, err)
+	fs = failingRenameFs{fs}
+	require.Error(t, conf.Set(DeviceKey, randomDevice()))
+	after, err := afero.ReadFile(fs, configFile)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+	requireNoTempFiles(t)
 }
 
-func TestSettingUpdated(t *testing.T) {
+type failingRenameFs struct {
+	afero.Fs
+}
+
+func (failingRenameFs) Rename(oldname, newname string) error {
+	return errors.New("rename failed")
+}
+
+func requireNoTempFiles(t *testing.T) {
+	infos, err := afero.ReadDir(fs, DefaultConfigDir)
+	require.NoError(t, err)
+	for _, info := range infos {
+		require.False(t, strings.Contains(info.Name(), ".tmp"), info.Name())
+	}
+}
+
+func TestRecoverBrokenConfig(t *testing.T) {
 	defer newFs(t, "")()
 	newNow()
+	configFile := path.Join(DefaultConfigDir, ConfigFileName)
 	conf, err := New(DefaultConfigDir)
 	require.NoError(t, err)
+	require.Empty(t, conf.Warnings())
+	d := randomDevice()
+	require.NoError(t, conf.Set(DeviceKey, d))
 
-	require.NoError(t, conf.Set(DeviceKey, randomDevice()))
-	require.Equal(t, conf.Get(DeviceKey+".updated"), now())
+	broken := []byte("[device\n  id = ")
+	require.NoError(t, afero.WriteFile(fs, configFile, broken, 0644))
+	require.NoError(t, afero.WriteFile(fs, VendorDefaultsFile, []byte("[thermal-recorder]\n  max-secs = 300\n"), 0644))
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	require.Len(t, conf.Warnings(), 1)
+	recoveredErr, ok := conf.Warnings()[0].(*RecoveredError)
+	require.True(t, ok)
+	require.Equal(t, configFile+".broken-"+now().Format(brokenTimeFormat), recoveredErr.BrokenFile)
+
+	b, err := afero.ReadFile(fs, recoveredErr.BrokenFile)
+	require.NoError(t, err)
+	require.Equal(t, broken, b)
+	var d2 Device
+	require.NoError(t, conf.Unmarshal(DeviceKey, &d2))
+	require.Equal(t, d, d2)
+	// The other layers are read in over the recovered config.
+	recorder, err := ThermalRecorderSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, 300, recorder.MaxSecs)
+
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	require.Empty(t, conf.Warnings())
+
+	require.NoError(t, fs.Remove(configFile+".good"))
+	require.NoError(t, afero.WriteFile(fs, configFile, broken, 0644))
+	_, err = New(DefaultConfigDir)
+	require.Error(t, err)
 }
 
-func TestMapToLocation(t *testing.T) {
+func TestGoodFileFailure(t *testing.T) {
 	defer newFs(t, "")()
+	configFile := path.Join(DefaultConfigDir, ConfigFileName)
+	SetFs(&renameFailFs{Fs: fs, failed: goodFilePath(configFile)})
 	conf, err := New(DefaultConfigDir)
 	require.NoError(t, err)
 
-	newNow()
-	locationMap := map[string]interface{}{
-		"latitude":  "123.321",
-		"timestamp": now().Format(TimeFormat),
-	}
-	locationExpected := Location{
-		Latitude:  123.321,
-		Timestamp: now(),
+	// The config is still written if the good copy can't be updated.
+	d := randomDevice()
+	require.NoError(t, conf.Set(DeviceKey, d))
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	d2, err := DeviceSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, d, d2)
+}
+
+// renameFailFs fails to rename files to one name.
+type renameFailFs struct {
+	afero.Fs
+	failed string
+}
+
+func (r *renameFailFs) Rename(oldname, newname string) error {
+	if newname == r.failed {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrPermission}
 	}
-	var location Location
-	require.NoError(t, conf.SetFromMap(LocationKey, locationMap))
-	require.NoError(t, conf.Unmarshal(LocationKey, &location))
-	equalLocation(t, locationExpected, location)
+	return r.Fs.Rename(oldname, newname)
 }
 
-func TestMapToAudio(t *testing.T) {
+func TestTransaction(t *testing.T) {
 	defer newFs(t, "")()
 	conf, err := New(DefaultConfigDir)
 	require.NoError(t, err)
-	audioMap := map[string]interface{}{
-		"directory":      "/audio/directory",
-		"card":           "4",
-		"volume-control": "audio volume control",
-	}
-	audioExpected := Audio{
-		Dir:           "/audio/directory",
-		Card:          4,
-		VolumeControl: "audio volume control",
-	}
-	checkWritingMap(t, AudioKey, &Audio{}, &audioExpected, audioMap, conf)
+
+	d := randomDevice()
+	w := randomWindows()
+	l := randomLocation()
+	require.NoError(t, conf.Set(LocationKey, &l))
+	require.NoError(t, conf.Transaction(func(tx *Tx) error {
+		require.NoError(t, tx.Set(DeviceKey, d))
+		require.NoError(t, tx.SetFromMap(WindowsKey, map[string]interface{}{"power-on": w.PowerOn}))
+		require.NoError(t, tx.SetField(WindowsKey, "power-off", w.PowerOff))
+		return tx.Unset(LocationKey)
+	}))
+
+	conf2, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	var d2 Device
+	require.NoError(t, conf2.Unmarshal(DeviceKey, &d2))
+	require.Equal(t, d, d2)
+	var w2 Windows
+	require.NoError(t, conf2.Unmarshal(WindowsKey, &w2))
+	require.Equal(t, Windows{PowerOn: w.PowerOn, PowerOff: w.PowerOff}, w2)
+	var l2 Location
+	require.NoError(t, conf2.Unmarshal(LocationKey, &l2))
+	equalLocation(t, Location{}, l2)
 }
 
-func TestMapToBattery(t *testing.T) {
+func TestTransactionRollback(t *testing.T) {
 	defer newFs(t, "")()
+	configFile := path.Join(DefaultConfigDir, ConfigFileName)
 	conf, err := New(DefaultConfigDir)
 	require.NoError(t, err)
-	batteryMap := map[string]interface{}{"enable-voltage-readings": "true"}
-	batteryExpected := Battery{EnableVoltageReadings: true}
-	checkWritingMap(t, BatteryKey, &Battery{}, &batteryExpected, batteryMap, conf)
+	d := randomDevice()
+	require.NoError(t, conf.Set(DeviceKey, d))
+	before, err := afero.ReadFile(fs, configFile)
+	require.NoError(t, err)
+
+	txErr := errors.New("transaction failed")
+	require.Equal(t, txErr, conf.Transaction(func(tx *Tx) error {
+		require.NoError(t, tx.Set(DeviceKey, randomDevice()))
+		require.NoError(t, tx.Unset(DeviceKey))
+		return txErr
+	}))
+	require.Error(t, conf.Transaction(func(tx *Tx) error {
+		require.NoError(t, tx.Set(DeviceKey, randomDevice()))
+		return tx.SetField(PortsKey, "managementd", "0")
+	}))
+
+	after, err := afero.ReadFile(fs, configFile)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+	var d2 Device
+	require.NoError(t, conf.Unmarshal(DeviceKey, &d2))
+	require.Equal(t, d, d2)
 }
 
-func TestMapToDevice(t *testing.T) {
+func TestUnsetField(t *testing.T) {
 	defer newFs(t, "")()
+	newNow()
 	conf, err := New(DefaultConfigDir)
 	require.NoError(t, err)
-	deviceMap := map[string]interface{}{"Group": "a-group"}
-	deviceExpected := Device{Group: "a-group"}
-	checkWritingMap(t, DeviceKey, &Device{}, &deviceExpected, deviceMap, conf)
+
+	w := Windows{PowerOn: "08:00", PowerOff: "20:00", StartRecording: "-1h", StopRecording: "+1h"}
+	require.NoError(t, conf.Set(WindowsKey, w))
+	require.NoError(t, conf.Set(ThermalRecorderKey, ThermalRecorder{MinSecs: 700, MaxSecs: 800}))
+
+	now = func() time.Time { return time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC) }
+	require.NoError(t, conf.UnsetField(WindowsKey, "power-on"))
+	require.Equal(t, now(), conf.Get(WindowsKey+".updated"))
+	require.Error(t, conf.UnsetField(WindowsKey, "not-a-field"))
+	require.Error(t, conf.UnsetField("not-a-section", "power-on"))
+	// min-secs would be more than the default max-secs
+	require.Error(t, conf.UnsetField(ThermalRecorderKey, "max-secs"))
+
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	w.PowerOn = DefaultWindows().PowerOn
+	windows, err := WindowsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, w, windows)
+	isDefault, err := conf.IsDefault(WindowsKey, "power-on")
+	require.NoError(t, err)
+	require.True(t, isDefault)
+
+	require.NoError(t, conf.ResetToDefault(WindowsKey, "power-off", "start-recording"))
+	windows, err = WindowsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, "+1h", windows.StopRecording)
+	require.Equal(t, DefaultWindows().StartRecording, windows.StartRecording)
+
+	require.NoError(t, conf.ResetToDefault(WindowsKey))
+	windows, err = WindowsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, DefaultWindows(), windows)
 }
 
-func TestMapToModemd(t *testing.T) {
+func TestUnsetFieldWithoutAutoWrite(t *testing.T) {
 	defer newFs(t, "")()
 	conf, err := New(DefaultConfigDir)
 	require.NoError(t, err)
-	modemdMap := map[string]interface{}{
-		"test-interval": "10m4s",
-		"modems": []map[string]interface{}{
-			map[string]interface{}{
-				"name": "modem name",
-			},
-		},
-	}
-	modemdExpected := Modemd{
-		TestInterval: 10*time.Minute + 4*time.Second,
-		Modems:       []Modem{Modem{Name: "modem name"}},
-	}
-	checkWritingMap(t, ModemdKey, &Modemd{}, &modemdExpected, modemdMap, conf)
+	conf.AutoWrite = false
+
+	require.NoError(t, conf.SetField(WindowsKey, "power-on", "08:00"))
+	require.NoError(t, conf.SetField(WindowsKey, "power-off", "20:00"))
+	require.NoError(t, conf.UnsetField(WindowsKey, "power-on"))
+	require.NoError(t, conf.SetField(AudioKey, "card", "2"))
+	require.NoError(t, conf.Update())
+	require.NoError(t, conf.Write())
+
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	windows, err := WindowsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, DefaultWindows().PowerOn, windows.PowerOn)
+	require.Equal(t, "20:00", windows.PowerOff)
+	audio, err := AudioSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, 2, audio.Card)
 }
 
-func TestSetField(t *testing.T) {
+func TestPatch(t *testing.T) {
 	defer newFs(t, "")()
+	newNow()
 	conf, err := New(DefaultConfigDir)
 	require.NoError(t, err)
-	audio := Audio{
-		Dir:           "/audio/directory",
-		Card:          4,
-		VolumeControl: "audio volume control",
-	}
-	require.NoError(t, conf.Set(AudioKey, audio))
 
-	require.NoError(t, conf.SetField(AudioKey, "card", "5"))
-	require.Error(t, conf.SetField(AudioKey, "not-a-key", "5"))
+	require.NoError(t, conf.SetField(ModemdKey, "find-modem-timeout", "3m"))
+	require.NoError(t, conf.Patch(ModemdKey, []byte(`{
+		"test-interval": "30s",
+		"Connection-Timeout": "2m",
+		"find-modem-timeout": null,
+		"modems": [{"name": "new modem", "net-dev": "ppp0"}]
+	}`)))
+	require.NoError(t, conf.Patch(LocationKey, []byte(`{"latitude": -43.5, "timestamp": "2020-01-01T00:00:00Z"}`)))
 
-	var audio2 Audio
-	require.NoError(t, conf.Unmarshal(AudioKey, &audio2))
+	require.Error(t, conf.Patch(ModemdKey, []byte(`{"test-interval": "soon"}`)))
+	require.Error(t, conf.Patch(ModemdKey, []byte(`{"not-a-field": 1}`)))
+	require.Error(t, conf.Patch(ModemdKey, []byte(`{"modems": [{"name": "no net-dev"}]}`)))
+	require.Error(t, conf.Patch(ModemdKey, []byte(`["test-interval"]`)))
+	require.Error(t, conf.Patch(ModemdKey, []byte(`{`)))
+	require.Error(t, conf.Patch("not-a-section", []byte(`{}`)))
 
-	audioExpected := Audio{
-		Dir:           "/audio/directory",
-		Card:          5,
-		VolumeControl: "audio volume control",
-	}
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	modemd := DefaultModemd()
+	modemd.TestInterval = 30 * time.Second
+	modemd.ConnectionTimeout = 2 * time.Minute
+	modemd.Modems = []Modem{{Name: "new modem", NetDev: "ppp0"}}
+	modemd2, err := ModemdSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, modemd, modemd2)
+	isDefault, err := conf.IsDefault(ModemdKey, "find-modem-timeout")
+	require.NoError(t, err)
+	require.True(t, isDefault)
+	require.True(t, now().Truncate(time.Second).Equal(conf.v.GetTime(ModemdKey+".updated")))
 
-	require.Equal(t, audioExpected, audio2)
+	location, err := LocationSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, float32(-43.5), location.Latitude)
+	require.Equal(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), location.Timestamp.UTC())
 }
 
-func checkWritingMap(
-	t *testing.T,
-	key string,
-	s, expected interface{},
-	m map[string]interface{},
-	conf *Config) {
-	require.NoError(t, conf.SetFromMap(key, m))
-	require.NoError(t, conf.Unmarshal(key, s))
-	require.Equal(t, expected, s)
+func TestPatchWithoutAutoWrite(t *testing.T) {
+	defer newFs(t, "")()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	conf.AutoWrite = false
+
+	require.NoError(t, conf.Patch(WindowsKey, []byte(`{"power-on": "08:00"}`)))
+	require.NoError(t, conf.SetField(AudioKey, "card", "2"))
+	require.NoError(t, conf.Write())
+
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	windows, err := WindowsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, "08:00", windows.PowerOn)
+	audio, err := AudioSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, 2, audio.Card)
 }
 
-func newFs(t *testing.T, configFile string) func() {
-	fs := afero.NewMemMapFs()
-	SetFs(fs)
-	fsConfigFile := path.Join(DefaultConfigDir, ConfigFileName)
-	lockFileFunc, cleanupFunc := configtest.WriteConfigFromFile(t, configFile, fsConfigFile, fs)
-	SetLockFilePath(lockFileFunc)
-	return cleanupFunc
+func setMigrations(m []migration) func() {
+	old := migrations
+	migrations = m
+	return func() { migrations = old }
 }
 
-func newNow() {
-	n := time.Now()
-	now = func() time.Time {
-		return n
-	}
+func TestMigrate(t *testing.T) {
+	defer newFs(t, "")()
+	configFile := path.Join(DefaultConfigDir, ConfigFileName)
+	before := []byte("[windows]\n  power-on = \"08:00\"\n")
+	require.NoError(t, afero.WriteFile(fs, configFile, before, 0644))
+
+	runs := 0
+	defer setMigrations([]migration{
+		func(settings map[string]interface{}) error {
+			runs++
+			w := settings["windows"].(map[string]interface{})
+			w["power-off"] = w["power-on"]
+			return nil
+		},
+		func(settings map[string]interface{}) error {
+			runs++
+			delete(settings["windows"].(map[string]interface{}), "power-on")
+			return nil
+		},
+	})()
+
+	// Read only configs are only migrated in memory.
+	conf, err := NewReadOnly(DefaultConfigDir)
+	require.NoError(t, err)
+	require.Equal(t, "08:00", conf.Get("windows.power-off"))
+	require.Equal(t, 2, runs)
+	b, err := afero.ReadFile(fs, configFile)
+	require.NoError(t, err)
+	require.Equal(t, before, b)
+
+	beforeSettings, afterSettings, err := Migrate(DefaultConfigDir, true)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"power-on": "08:00"}, beforeSettings["windows"])
+	require.Equal(t, map[string]interface{}{"power-off": "08:00"}, afterSettings["windows"])
+	require.EqualValues(t, 2, afterSettings[SchemaVersionKey])
+	b, err = afero.ReadFile(fs, configFile)
+	require.NoError(t, err)
+	require.Equal(t, before, b)
+
+	runs = 0
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	require.Equal(t, 2, runs)
+	b, err = afero.ReadFile(fs, configFile+".schema-0")
+	require.NoError(t, err)
+	require.Equal(t, before, b)
+
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	require.Equal(t, 2, runs)
+	require.Equal(t, 2, conf.v.GetInt(SchemaVersionKey))
+	require.Equal(t, "08:00", conf.Get("windows.power-off"))
+	require.Nil(t, conf.Get("windows.power-on"))
+	require.Empty(t, conf.Warnings())
 }
 
-func randomDevice() (d Device) {
-	fako.Fuzz(&d)
-	return
+func TestMigrateNewerSchema(t *testing.T) {
+	defer newFs(t, "")()
+	configFile := path.Join(DefaultConfigDir, ConfigFileName)
+	require.NoError(t, afero.WriteFile(fs, configFile, []byte("schema-version = 5\n"), 0644))
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	require.Len(t, conf.Warnings(), 1)
+	require.Equal(t, 5, conf.Warnings()[0].(*SchemaVersionError).Version)
 }
 
-func randomWindows() (w Windows) {
-	fako.Fuzz(&w)
-	return
+func TestMigrateFailure(t *testing.T) {
+	defer newFs(t, "./test-files/test.toml")()
+	configFile := path.Join(DefaultConfigDir, ConfigFileName)
+	before, err := afero.ReadFile(fs, configFile)
+	require.NoError(t, err)
+	defer setMigrations([]migration{
+		func(settings map[string]interface{}) error {
+			delete(settings, "windows")
+			return errors.New("migration failed")
+		},
+	})()
+	_, err = New(DefaultConfigDir)
+	require.Error(t, err)
+	after, err := afero.ReadFile(fs, configFile)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
+
+func TestDynamicThresholdMigration(t *testing.T) {
+	defer newFs(t, "")()
+	configFile := path.Join(DefaultConfigDir, ConfigFileName)
+	require.NoError(t, afero.WriteFile(fs, configFile, []byte("[thermal-motion]\n  min-secs = false\n"), 0644))
+
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	thermalMotion, err := ThermalMotionSection.Load(conf)
+	require.NoError(t, err)
+	require.False(t, thermalMotion.DynamicThreshold)
+
+	b, err := afero.ReadFile(fs, configFile)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "dynamic-threshold = false")
+	require.NotContains(t, string(b), "min-secs")
+	require.Contains(t, string(b), "schema-version = "+strconv.Itoa(SchemaVersion()))
+}
+
+func TestDynamicThresholdLegacyKey(t *testing.T) {
+	defer newFs(t, "")()
+	configFile := path.Join(DefaultConfigDir, ConfigFileName)
+	legacy := []byte("schema-version = 1\n\n[thermal-motion]\n  min-secs = false\n")
+	require.NoError(t, afero.WriteFile(fs, configFile, legacy, 0644))
+
+	conf, err := NewReadOnly(DefaultConfigDir)
+	require.NoError(t, err)
+	thermalMotion, err := ThermalMotionSection.Load(conf)
+	require.NoError(t, err)
+	require.False(t, thermalMotion.DynamicThreshold)
+
+	s, err := allSections[ThermalMotionKey].mapToStruct(map[string]interface{}{"min-secs": false})
+	require.NoError(t, err)
+	require.False(t, s.(ThermalMotion).DynamicThreshold)
+
+	// The legacy key is rewritten on the next save.
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	require.NoError(t, conf.Set(AudioKey, Audio{Card: 1}))
+	b, err := afero.ReadFile(fs, configFile)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "dynamic-threshold = false")
+	require.NotContains(t, string(b), "min-secs")
+}
+
+func TestHistory(t *testing.T) {
+	defer newFs(t, "")()
+	newNow()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+
+	require.NoError(t, conf.SetField(WindowsKey, "power-on", "08:00"))
+	require.NoError(t, conf.SetField(AudioKey, "card", "2"))
+	require.NoError(t, conf.SetField(WindowsKey, "power-on", "09:00"))
+
+	entries, err := conf.History()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, 3, entries[0].ID)
+	require.Equal(t, []string{WindowsKey}, entries[0].Sections)
+	require.Equal(t, Change{Key: "windows.power-on", Old: "08:00", New: "09:00"}, entries[0].Changes[0])
+	require.Equal(t, []string{AudioKey}, entries[1].Sections)
+	require.Equal(t, Change{Key: "audio.card", New: float64(2)}, entries[1].Changes[0])
+	require.Equal(t, os.Getpid(), entries[0].PID)
+	require.NotEmpty(t, entries[0].Process)
+
+	require.NoError(t, conf.Rollback(2))
+	require.Equal(t, "08:00", conf.Get("windows.power-on"))
+	require.Nil(t, conf.Get("audio.card"))
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	require.Equal(t, "08:00", conf.Get("windows.power-on"))
+	require.Nil(t, conf.Get("audio.card"))
+
+	// The rollback can be undone.
+	require.NoError(t, conf.Rollback(1))
+	require.Equal(t, "09:00", conf.Get("windows.power-on"))
+	require.EqualValues(t, 2, conf.Get("audio.card"))
+
+	require.Error(t, conf.Rollback(0))
+	require.Error(t, conf.Rollback(10))
+	readOnly, err := NewReadOnly(DefaultConfigDir)
+	require.NoError(t, err)
+	require.Equal(t, ErrReadOnly, readOnly.Rollback(1))
+	entries, err = readOnly.History()
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+}
+
+func TestHistorySize(t *testing.T) {
+	defer newFs(t, "")()
+	historySize = 3
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, conf.SetField(AudioKey, "card", strconv.Itoa(i)))
+	}
+	entries, err := conf.History()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, 5, entries[0].ID)
+	require.Equal(t, 3, entries[2].ID)
+}
+
+func readAuditEntries(t *testing.T) []AuditEntry {
+	b, err := afero.ReadFile(fs, DefaultAuditLogFile)
+	require.NoError(t, err)
+	entries := []AuditEntry{}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var entry AuditEntry
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAudit(t *testing.T) {
+	defer newFs(t, "")()
+	newNow()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	conf.AuditTag = "test"
+
+	w := Windows{PowerOn: "08:00", PowerOff: "20:00", StartRecording: "-1h", StopRecording: "+1h"}
+	require.NoError(t, conf.Set(WindowsKey, w))
+	require.NoError(t, conf.SetFromMap(SecretsKey, map[string]interface{}{"device-password": "pass"}))
+	require.NoError(t, conf.SetFromMap(SecretsKey, map[string]interface{}{"device-password": "pass"}))
+	require.NoError(t, conf.SetField(AudioKey, "card", "2"))
+	require.Error(t, conf.SetField(AudioKey, "card", "-1"))
+	require.NoError(t, conf.Unset(AudioKey))
+	require.NoError(t, conf.Rollback(1))
+
+	entries := readAuditEntries(t)
+	ops := []string{}
+	for _, entry := range entries {
+		ops = append(ops, entry.Op)
+		require.Equal(t, "test", entry.Tag)
+		require.Equal(t, os.Getpid(), entry.PID)
+	}
+	require.Equal(t, []string{"Set", "SetFromMap", "SetField", "Unset", "Rollback"}, ops)
+
+	require.Equal(t, []string{WindowsKey}, entries[0].Sections)
+	require.Contains(t, entries[0].Changes, Change{Key: "windows.power-on", New: "08:00"})
+	require.True(t, IsSecretSection(SecretsKey))
+	require.Contains(t, entries[1].Changes, Change{Key: "secrets.device-password", New: Redacted})
+	require.Equal(t, Change{Key: "audio.card", New: float64(2)}, entries[2].Changes[0])
+	require.Equal(t, Change{Key: "audio.card", Old: float64(2)}, entries[3].Changes[0])
+	require.Equal(t, Change{Key: "audio.card", New: float64(2)}, entries[4].Changes[0])
+}
+
+type testAuditSink []AuditEntry
+
+func (s *testAuditSink) Audit(entry AuditEntry) error {
+	*s = append(*s, entry)
+	return nil
+}
+
+func TestAuditSink(t *testing.T) {
+	defer newFs(t, "")()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	sink := &testAuditSink{}
+	conf.AuditSink = sink
+	require.NoError(t, conf.Transaction(func(tx *Tx) error {
+		if err := tx.SetField(AudioKey, "card", "2"); err != nil {
+			return err
+		}
+		return tx.SetField(WindowsKey, "power-on", "08:00")
+	}))
+	require.Len(t, *sink, 1)
+	require.Equal(t, "Transaction", (*sink)[0].Op)
+	require.Equal(t, []string{AudioKey, WindowsKey}, (*sink)[0].Sections)
+	exists, err := afero.Exists(fs, DefaultAuditLogFile)
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestAuditWithoutAutoWrite(t *testing.T) {
+	defer newFs(t, "")()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	sink := &testAuditSink{}
+	conf.AuditSink = sink
+	conf.AutoWrite = false
+
+	// Changes are only audited once they are written.
+	require.NoError(t, conf.SetField(WindowsKey, "power-on", "08:00"))
+	require.NoError(t, conf.UnsetField(WindowsKey, "power-on"))
+	require.NoError(t, conf.SetField(AudioKey, "card", "2"))
+	require.Empty(t, *sink)
+	require.NoError(t, conf.Write())
+	require.Len(t, *sink, 1)
+	require.Equal(t, "Write", (*sink)[0].Op)
+	require.Equal(t, []string{AudioKey, WindowsKey}, (*sink)[0].Sections)
+	require.NotContains(t, (*sink)[0].Changes, Change{Key: "windows.power-on", New: "08:00"})
+
+	require.NoError(t, conf.Write())
+	require.Len(t, *sink, 1)
+}
+
+func TestUnitFromCgroup(t *testing.T) {
+	require.Equal(t, "thermal-recorder.service", unitFromCgroup("0::/system.slice/thermal-recorder.service\n"))
+	require.Equal(t, "modemd.service",
+		unitFromCgroup("2:cpu:/\n1:name=systemd:/system.slice/modemd.service\n0::/system.slice/modemd.service\n"))
+	require.Equal(t, "", unitFromCgroup("0::/user.slice/user-1000.slice/session-2.scope\n"))
+	require.Equal(t, "", unitFromCgroup(""))
+}
+
+func setCurrentUnit(unit string) func() {
+	old := currentUnit
+	currentUnit = func() string { return unit }
+	return func() { currentUnit = old }
+}
+
+func TestRestartUnits(t *testing.T) {
+	defer newFs(t, "")()
+
+	defer setCurrentUnit("thermal-recorder.service")()
+	conf, err := NewReadOnly(DefaultConfigDir)
+	require.NoError(t, err)
+	_, err = ThermalRecorderSection.Load(conf)
+	require.NoError(t, err)
+	_, err = WindowsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, []string{ThermalRecorderKey, WindowsKey}, conf.AccessedSections())
+
+	// The units file isn't written if the unit already has the section, and
+	// it doesn't need the config lock.
+	unitsFile := unitsFilePath(path.Join(DefaultConfigDir, ConfigFileName))
+	info, err := fs.Stat(unitsFile)
+	require.NoError(t, err)
+	conf, err = NewReadOnly(DefaultConfigDir)
+	require.NoError(t, err)
+	_, err = WindowsSection.Load(conf)
+	require.NoError(t, err)
+	info2, err := fs.Stat(unitsFile)
+	require.NoError(t, err)
+	require.Equal(t, info.ModTime(), info2.ModTime())
+	writer, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	require.NoError(t, writer.fileLock.lock())
+	_, err = LocationSection.Load(conf)
+	require.NoError(t, err)
+	require.NoError(t, writer.fileLock.unlock())
+	units, err := conf.UnitsForSections([]string{LocationKey})
+	require.NoError(t, err)
+	require.Equal(t, []string{"thermal-recorder.service"}, units)
+
+	setCurrentUnit("cacophony-config-dbus.service")
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	conf.RecordAccess = false
+	_, err = WindowsSection.Load(conf)
+	require.NoError(t, err)
+	require.Empty(t, conf.AccessedSections())
+
+	setCurrentUnit("attiny-controller.service")
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	windows := Windows{}
+	require.NoError(t, conf.Unmarshal(WindowsKey, &windows))
+
+	setCurrentUnit("managementd.service")
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	restarter := &configtest.FakeRestarter{}
+	conf.Restarter = restarter
+	_, err = WindowsSection.Load(conf)
+	require.NoError(t, err)
+
+	units, err = conf.UnitsForSections([]string{WindowsKey})
+	require.NoError(t, err)
+	require.Equal(t, []string{"attiny-controller.service", "managementd.service", "thermal-recorder.service"}, units)
+
+	require.NoError(t, conf.SetField(ThermalRecorderKey, "max-secs", "60"))
+	require.Equal(t, []string{"thermal-recorder.service"}, restarter.Restarted)
+	restarter.Restarted = nil
+	// The unit changing the config is not restarted.
+	require.NoError(t, conf.SetField(WindowsKey, "power-on", "08:00"))
+	require.Equal(t, []string{"attiny-controller.service", "thermal-recorder.service"}, restarter.Restarted)
+	restarter.Restarted = nil
+	require.NoError(t, conf.SetField(AudioKey, "card", "2"))
+	require.Empty(t, restarter.Restarted)
+
+	conf.AutoWrite = false
+	require.NoError(t, conf.SetField(WindowsKey, "power-on", "09:00"))
+	require.Empty(t, restarter.Restarted)
+}
+
+func TestSectionValues(t *testing.T) {
+	defer newFs(t, "")()
+	defer setCurrentUnit("")()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	require.NoError(t, conf.SetField(ModemdKey, "test-interval", "30s"))
+	require.NoError(t, conf.SetField(LocationKey, "timestamp", "2020-01-01T00:00:00Z"))
+
+	modemd, err := conf.SectionValues(ModemdKey)
+	require.NoError(t, err)
+	require.Equal(t, "30s", modemd["test-interval"])
+	require.Equal(t, "2m0s", modemd["find-modem-timeout"])
+	require.Equal(t, "eth1", modemd["modems"].([]interface{})[0].(map[string]interface{})["net-dev"])
+	location, err := conf.SectionValues(LocationKey)
+	require.NoError(t, err)
+	require.Equal(t, "2020-01-01T00:00:00Z", location["timestamp"])
+	require.Empty(t, conf.AccessedSections())
+
+	_, err = conf.SectionValues("not-a-section")
+	require.Error(t, err)
+}
+
+func TestRedactedSectionValues(t *testing.T) {
+	defer newFs(t, "")()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	require.NoError(t, conf.SetField(SecretsKey, "device-password", "pass"))
+	require.NoError(t, conf.SetField(WindowsKey, "power-on", "08:00"))
+
+	secrets, err := conf.RedactedSectionValues(SecretsKey)
+	require.NoError(t, err)
+	require.Equal(t, Redacted, secrets["device-password"])
+	windows, err := conf.RedactedSectionValues(WindowsKey)
+	require.NoError(t, err)
+	require.Equal(t, "08:00", windows["power-on"])
+	secrets, err = conf.SectionValues(SecretsKey)
+	require.NoError(t, err)
+	require.Equal(t, "pass", secrets["device-password"])
+}
+
+func TestLayers(t *testing.T) {
+	defer newFs(t, "")()
+	configFile := path.Join(DefaultConfigDir, ConfigFileName)
+	dropInDir := path.Join(DefaultConfigDir, DropInDirName)
+	files := map[string]string{
+		VendorDefaultsFile:                "[windows]\n  power-on = \"07:00\"\n  power-off = \"19:00\"\n[thermal-recorder]\n  max-secs = 300\n",
+		configFile:                        "[windows]\n  power-off = \"20:00\"\n",
+		path.Join(dropInDir, "20-b.toml"): "[windows]\n  start-recording = \"-3h\"\n",
+		path.Join(dropInDir, "10-a.toml"): "[windows]\n  start-recording = \"-2h\"\n",
+		path.Join(dropInDir, "30-c.toml"): "[windows\n",
+		path.Join(dropInDir, "notes.txt"): "not a config file",
+	}
+	for file, contents := range files {
+		require.NoError(t, afero.WriteFile(fs, file, []byte(contents), 0644))
+	}
+
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	require.Len(t, conf.Warnings(), 1)
+	windows, err := WindowsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, Windows{PowerOn: "07:00", PowerOff: "20:00", StartRecording: "-3h", StopRecording: "+30m"}, windows)
+
+	origins := map[string]string{
+		"power-on":        VendorDefaultsFile,
+		"power-off":       configFile,
+		"start-recording": path.Join(dropInDir, "20-b.toml"),
+		"stop-recording":  OriginDefault,
+	}
+	for field, origin := range origins {
+		o, err := conf.Origin(WindowsKey, field)
+		require.NoError(t, err)
+		require.Equal(t, origin, o, field)
+	}
+	_, err = conf.Origin(WindowsKey, "not-a-field")
+	require.Error(t, err)
+	isDefault, err := conf.IsDefault(WindowsKey, "power-on")
+	require.NoError(t, err)
+	require.False(t, isDefault)
+
+	// Only config.toml is written and values from the other layers aren't copied to it.
+	require.NoError(t, conf.SetField(WindowsKey, "stop-recording", "+1h"))
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	b, err := afero.ReadFile(fs, configFile)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "stop-recording")
+	require.NotContains(t, string(b), "power-on")
+	require.NotContains(t, string(b), "start-recording")
+	windows, err = WindowsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, "+1h", windows.StopRecording)
+	require.Equal(t, "-3h", windows.StartRecording)
+
+	// Changes are validated against the values from the layers below config.toml.
+	require.Error(t, conf.SetField(ThermalRecorderKey, "min-secs", "400"))
+	require.NoError(t, conf.SetField(ThermalRecorderKey, "min-secs", "200"))
+}
+
+func TestBindEnv(t *testing.T) {
+	defer newFs(t, "./test-files/test.toml")()
+	t.Setenv("CACOPHONY_THERMAL_RECORDER_MAX_SECS", "60")
+	t.Setenv("CACOPHONY_MODEMD_TEST_INTERVAL", "30s")
+	t.Setenv("CACOPHONY_LOCATION_TIMESTAMP", "2020-01-02T03:04:05Z")
+
+	// Environment variables are only used once they are bound.
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	recorder, err := ThermalRecorderSection.Load(conf)
+	require.NoError(t, err)
+	require.NotEqual(t, 60, recorder.MaxSecs)
+
+	require.NoError(t, conf.BindEnv())
+	recorder, err = ThermalRecorderSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, 60, recorder.MaxSecs)
+	modemd, err := ModemdSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, modemd.TestInterval)
+	location, err := LocationSection.Load(conf)
+	require.NoError(t, err)
+	require.True(t, location.Timestamp.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)))
+	origin, err := conf.Origin(ThermalRecorderKey, "max-secs")
+	require.NoError(t, err)
+	require.Equal(t, "CACOPHONY_THERMAL_RECORDER_MAX_SECS", origin)
+
+	// Overridden values are not written and still override after writes.
+	require.NoError(t, conf.SetField(ThermalRecorderKey, "min-secs", "10"))
+	b, err := afero.ReadFile(fs, path.Join(DefaultConfigDir, ConfigFileName))
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "max-secs = 60")
+	require.NotContains(t, string(b), "test-interval")
+	recorder, err = ThermalRecorderSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, 10, recorder.MinSecs)
+	require.Equal(t, 60, recorder.MaxSecs)
+
+	t.Setenv("CACOPHONY_MODEMD_TEST_INTERVAL", "soon")
+	require.Error(t, conf.BindEnv())
+}
+
+func TestSecretsFile(t *testing.T) {
+	defer newFs(t, "")()
+	configFile := path.Join(DefaultConfigDir, ConfigFileName)
+	secretsFile := path.Join(DefaultConfigDir, SecretsFileName)
+	old := "schema-version = 1\n\n[secrets]\n  device-password = \"old-pass\"\n\n[windows]\n  power-on = \"08:00\"\n"
+	require.NoError(t, afero.WriteFile(fs, configFile, []byte(old), 0644))
+
+	// A dry run shows the secrets leaving config.toml without their values.
+	before, after, err := Migrate(DefaultConfigDir, true)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"device-password": Redacted}, before[SecretsKey])
+	require.NotContains(t, after, SecretsKey)
+	require.Contains(t, DiffSettings(before, after), Change{Key: "secrets.device-password", Old: Redacted})
+
+	// The migration moves the secrets out of config.toml.
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	secrets, err := SecretsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, "old-pass", secrets.DevicePassword)
+	b, err := afero.ReadFile(fs, configFile)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "pass")
+	require.Contains(t, string(b), "power-on")
+	b, err = afero.ReadFile(fs, secretsFile)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "old-pass")
+	for _, file := range []string{secretsFile, configFile + ".schema-1"} {
+		info, err := fs.Stat(file)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(secretsFileMode), info.Mode().Perm(), file)
+	}
+	// The last known good copy is made after the migration.
+	b, err = afero.ReadFile(fs, goodFilePath(configFile))
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "pass")
+	origin, err := conf.Origin(SecretsKey, "device-password")
+	require.NoError(t, err)
+	require.Equal(t, secretsFile, origin)
+
+	// Secrets are written to the secrets file and aren't kept in the history.
+	require.NoError(t, conf.SetField(SecretsKey, "device-password", "new-pass"))
+	require.NoError(t, conf.SetField(WindowsKey, "power-on", "09:00"))
+	b, err = afero.ReadFile(fs, configFile)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "pass")
+	records, err := readHistory(configFile)
+	require.NoError(t, err)
+	for _, record := range records {
+		require.NotContains(t, record.Snapshot, "pass")
+	}
+	require.NoError(t, conf.Rollback(len(records)))
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	secrets, err = SecretsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, "new-pass", secrets.DevicePassword)
+	b, err = afero.ReadFile(fs, configFile)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "pass")
+
+	// Callers that can't read the secrets file can read everything else.
+	SetFs(&permissionFs{Fs: fs, denied: secretsFile})
+	conf, err = NewReadOnly(DefaultConfigDir)
+	require.NoError(t, err)
+	_, err = SecretsSection.Load(conf)
+	require.IsType(t, &SecretsError{}, err)
+	_, err = WindowsSection.Load(conf)
+	require.NoError(t, err)
+}
+
+func TestSecretsFileWriteFailure(t *testing.T) {
+	defer newFs(t, "")()
+	configFile := path.Join(DefaultConfigDir, ConfigFileName)
+	secretsFile := path.Join(DefaultConfigDir, SecretsFileName)
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	memFs := fs
+
+	// A new secrets file is removed if config.toml can't be written.
+	SetFs(&renameFailFs{Fs: memFs, failed: configFile})
+	require.Error(t, conf.Transaction(func(tx *Tx) error {
+		if err := tx.SetField(SecretsKey, "device-password", "new-pass"); err != nil {
+			return err
+		}
+		return tx.SetField(WindowsKey, "power-on", "08:00")
+	}))
+	_, err = fs.Stat(secretsFile)
+	require.True(t, os.IsNotExist(err))
+
+	// An existing secrets file is put back.
+	SetFs(memFs)
+	require.NoError(t, conf.SetField(SecretsKey, "device-password", "old-pass"))
+	old, err := afero.ReadFile(fs, secretsFile)
+	require.NoError(t, err)
+	SetFs(&renameFailFs{Fs: memFs, failed: configFile})
+	require.Error(t, conf.SetField(SecretsKey, "device-password", "new-pass"))
+	b, err := afero.ReadFile(fs, secretsFile)
+	require.NoError(t, err)
+	require.Equal(t, old, b)
+	secrets, err := SecretsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, "old-pass", secrets.DevicePassword)
+}
+
+// permissionFs denies opening one file, as if the caller doesn't have
+// permission to read it.
+type permissionFs struct {
+	afero.Fs
+	denied string
+}
+
+func (p *permissionFs) Open(name string) (afero.File, error) {
+	if name == p.denied {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	return p.Fs.Open(name)
+}
+
+func TestFileLock(t *testing.T) {
+	defer newFs(t, "")()
+	lockTimeout = time.Millisecond * 100
+
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	conf2, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+
+	require.NoError(t, conf.fileLock.lock())
+	require.Equal(t, context.DeadlineExceeded, conf2.fileLock.lock())
+	require.NoError(t, conf.fileLock.unlock())
+	require.NoError(t, conf2.fileLock.lock())
+	require.NoError(t, conf2.fileLock.unlock())
+}
+
+func TestReentrantFileLock(t *testing.T) {
+	defer newFs(t, "")()
+	lockTimeout = time.Millisecond * 100
+
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	conf2, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+
+	require.NoError(t, conf.fileLock.lock())
+	require.NoError(t, conf.Update())
+	require.NoError(t, conf.Set(DeviceKey, randomDevice()))
+	require.Equal(t, context.DeadlineExceeded, conf2.fileLock.lock())
+	require.NoError(t, conf.fileLock.unlock())
+	require.Equal(t, errNotLocked, conf.fileLock.unlock())
+	require.NoError(t, conf2.fileLock.lock())
+	require.NoError(t, conf2.fileLock.unlock())
+}
+
+func TestSharedFileLock(t *testing.T) {
+	defer newFs(t, "")()
+	lockTimeout = time.Millisecond * 100
+
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	conf2, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+
+	require.NoError(t, conf.fileLock.rlock())
+	require.NoError(t, conf2.Update())
+	_, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	require.Equal(t, context.DeadlineExceeded, conf2.Set(DeviceKey, randomDevice()))
+	require.NoError(t, conf.fileLock.unlock())
+	require.NoError(t, conf2.Set(DeviceKey, randomDevice()))
+
+	// Upgrading to an exclusive lock.
+	require.NoError(t, conf.fileLock.rlock())
+	require.NoError(t, conf.Set(DeviceKey, randomDevice()))
+	require.Equal(t, context.DeadlineExceeded, conf2.Update())
+	require.NoError(t, conf.fileLock.unlock())
+	require.NoError(t, conf2.Update())
+}
+
+func TestSeedGoodFileDoesNotWait(t *testing.T) {
+	defer newFs(t, "")()
+	lockTimeout = 10 * time.Second
+	goodFile := goodFilePath(path.Join(DefaultConfigDir, ConfigFileName))
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	require.NoError(t, fs.Remove(goodFile))
+
+	require.NoError(t, conf.fileLock.rlock())
+	start := time.Now()
+	_, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	require.True(t, time.Since(start) < lockTimeout/2, "New waited for the lock")
+	_, err = fs.Stat(goodFile)
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, conf.fileLock.unlock())
+	_, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	_, err = fs.Stat(goodFile)
+	require.NoError(t, err)
+}
+
+func TestReadOnly(t *testing.T) {
+	defer newFs(t, "./test-files/test.toml")()
+	SetLockFilePath(func(string) string {
+		return path.Join(os.TempDir(), "not-a-dir", "config.toml.lock")
+	})
+
+	_, err := New(DefaultConfigDir)
+	require.Error(t, err)
+	conf, err := NewReadOnly(DefaultConfigDir)
+	require.NoError(t, err)
+	var device Device
+	require.NoError(t, conf.Unmarshal(DeviceKey, &device))
+	require.Equal(t, 789, device.ID)
+	require.NoError(t, conf.Update())
+
+	require.Equal(t, ErrReadOnly, conf.Set(DeviceKey, randomDevice()))
+	require.Equal(t, ErrReadOnly, conf.SetField(DeviceKey, "id", "2"))
+	require.Equal(t, ErrReadOnly, conf.Unset(DeviceKey))
+	require.Equal(t, ErrReadOnly, conf.Write())
+	_, err = fs.Stat(path.Join(DefaultConfigDir, ConfigFileName+".good"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestInterleavedWrites(t *testing.T) {
+	defer newFs(t, "")()
+	lockTimeout = 10 * time.Second
+	lockRetryDelay = time.Millisecond
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	conf2, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+
+	const n = 20
+	errs := make(chan error, 2)
+	go func() {
+		for i := 1; i <= n; i++ {
+			if err := conf.Set(PortsKey, Ports{Managementd: i}); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	go func() {
+		for i := 1; i <= n; i++ {
+			if err := conf2.Set(AudioKey, Audio{Card: i}); err != nil {
+				errs <- err
+				return
+			}
+			if err := conf2.Unset(LocationKey); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	var ports Ports
+	require.NoError(t, conf.Unmarshal(PortsKey, &ports))
+	require.Equal(t, n, ports.Managementd)
+	var audio Audio
+	require.NoError(t, conf.Unmarshal(AudioKey, &audio))
+	require.Equal(t, n, audio.Card)
+}
+
+func TestSettingUpdated(t *testing.T) {
+	defer newFs(t, "")()
+	newNow()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+
+	require.NoError(t, conf.Set(DeviceKey, randomDevice()))
+	require.Equal(t, conf.Get(DeviceKey+".updated"), now())
+}
+
+func TestStrictSet(t *testing.T) {
+	defer newFs(t, "")()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+
+	updated := time.Now()
+	w := randomWindows()
+	require.NoError(t, conf.StrictSet(WindowsKey, &w, updated))
+	require.Equal(t, updated, conf.Get(WindowsKey+".updated"))
+
+	w2 := randomWindows()
+	for _, u := range []time.Time{updated, updated.Add(-time.Hour)} {
+		err = conf.StrictSet(WindowsKey, &w2, u)
+		require.Error(t, err)
+		staleErr, ok := err.(*StaleUpdateError)
+		require.True(t, ok)
+		require.Equal(t, WindowsKey, staleErr.Section)
+	}
+
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	w3 := Windows{}
+	require.NoError(t, conf.Unmarshal(WindowsKey, &w3))
+	require.Equal(t, w, w3)
+
+	updated = updated.Add(time.Minute)
+	require.NoError(t, conf.StrictSetFromMap(WindowsKey, map[string]interface{}{"power-on": "10:00"}, updated))
+	require.NoError(t, conf.Unmarshal(WindowsKey, &w3))
+	require.Equal(t, "10:00", w3.PowerOn)
+	_, ok := conf.StrictSetFromMap(WindowsKey, map[string]interface{}{}, updated).(*StaleUpdateError)
+	require.True(t, ok)
+}
+
+func TestMapToLocation(t *testing.T) {
+	defer newFs(t, "")()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+
+	newNow()
+	locationMap := map[string]interface{}{
+		"latitude":  "-43.321",
+		"timestamp": now().Format(TimeFormat),
+	}
+	locationExpected := Location{
+		Latitude:  -43.321,
+		Timestamp: now(),
+	}
+	var location Location
+	require.NoError(t, conf.SetFromMap(LocationKey, locationMap))
+	require.NoError(t, conf.Unmarshal(LocationKey, &location))
+	equalLocation(t, locationExpected, location)
+}
+
+func TestMapToAudio(t *testing.T) {
+	defer newFs(t, "")()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	audioMap := map[string]interface{}{
+		"directory":      "/audio/directory",
+		"card":           "4",
+		"volume-control": "audio volume control",
+	}
+	audioExpected := Audio{
+		Dir:           "/audio/directory",
+		Card:          4,
+		VolumeControl: "audio volume control",
+	}
+	checkWritingMap(t, AudioKey, &Audio{}, &audioExpected, audioMap, conf)
+}
+
+func TestMapToBattery(t *testing.T) {
+	defer newFs(t, "")()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	batteryMap := map[string]interface{}{"enable-voltage-readings": "true"}
+	batteryExpected := Battery{EnableVoltageReadings: true}
+	checkWritingMap(t, BatteryKey, &Battery{}, &batteryExpected, batteryMap, conf)
+}
+
+func TestMapToDevice(t *testing.T) {
+	defer newFs(t, "")()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	deviceMap := map[string]interface{}{"Group": "a-group"}
+	deviceExpected := Device{Group: "a-group"}
+	checkWritingMap(t, DeviceKey, &Device{}, &deviceExpected, deviceMap, conf)
+}
+
+func TestMapToModemd(t *testing.T) {
+	defer newFs(t, "")()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	modemdMap := map[string]interface{}{
+		"test-interval": "10m4s",
+		"modems": []map[string]interface{}{
+			map[string]interface{}{
+				"name":    "modem name",
+				"net-dev": "wwan0",
+			},
+		},
+	}
+	modemdExpected := Modemd{
+		TestInterval: 10*time.Minute + 4*time.Second,
+		Modems:       []Modem{Modem{Name: "modem name", NetDev: "wwan0"}},
+	}
+	checkWritingMap(t, ModemdKey, &Modemd{}, &modemdExpected, modemdMap, conf)
+}
+
+func TestSetField(t *testing.T) {
+	defer newFs(t, "")()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	audio := Audio{
+		Dir:           "/audio/directory",
+		Card:          4,
+		VolumeControl: "audio volume control",
+	}
+	require.NoError(t, conf.Set(AudioKey, audio))
+
+	require.NoError(t, conf.SetField(AudioKey, "card", "5"))
+	require.Error(t, conf.SetField(AudioKey, "not-a-key", "5"))
+
+	var audio2 Audio
+	require.NoError(t, conf.Unmarshal(AudioKey, &audio2))
+
+	audioExpected := Audio{
+		Dir:           "/audio/directory",
+		Card:          5,
+		VolumeControl: "audio volume control",
+	}
+
+	require.Equal(t, audioExpected, audio2)
+}
+
+func TestValidation(t *testing.T) {
+	defer newFs(t, "")()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+
+	err = conf.Set(LocationKey, Location{Latitude: 91, Longitude: -181})
+	require.Error(t, err)
+	validationErr, ok := err.(ValidationError)
+	require.True(t, ok)
+	require.Equal(t, ValidationError{
+		&FieldError{Section: LocationKey, Field: "latitude", Value: float32(91), Reason: "must be between -90 and 90"},
+		&FieldError{Section: LocationKey, Field: "longitude", Value: float32(-181), Reason: "must be between -180 and 180"},
+	}, validationErr)
+	require.False(t, conf.v.IsSet(LocationKey))
+
+	r := DefaultThermalRecorder()
+	r.MinSecs = r.MaxSecs + 1
+	require.Error(t, conf.Set(ThermalRecorderKey, r))
+	require.Error(t, conf.SetFromMap(ModemdKey, map[string]interface{}{
+		"modems": []map[string]interface{}{{"name": "no net-dev"}},
+	}))
+	require.NoError(t, conf.SetField(PortsKey, "managementd", "8080"))
+	require.Error(t, conf.SetField(PortsKey, "managementd", "0"))
+	require.Error(t, conf.SetField(PortsKey, "managementd", "65536"))
+	require.Error(t, conf.SetField(WindowsKey, "power-on", "noon"))
+
+	ports := DefaultPorts()
+	require.NoError(t, conf.Unmarshal(PortsKey, &ports))
+	require.Equal(t, 8080, ports.Managementd)
+
+	// A nil section is an error rather than clearing the section.
+	require.Error(t, conf.Set(PortsKey, nil))
+	require.Error(t, conf.Set(PortsKey, (*Ports)(nil)))
+	require.NoError(t, conf.Unmarshal(PortsKey, &ports))
+	require.Equal(t, 8080, ports.Managementd)
+}
+
+func TestValidationOnRead(t *testing.T) {
+	restoreGlobals(t)
+	fs := afero.NewMemMapFs()
+	SetFs(fs)
+	fsConfigFile := path.Join(DefaultConfigDir, ConfigFileName)
+	lockFileFunc, cleanup := configtest.WriteConfigFromBytes(t, []byte("[ports]\n  managementd = 70000\n"), fsConfigFile, fs)
+	defer cleanup()
+	SetLockFilePath(lockFileFunc)
+
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	ports := DefaultPorts()
+	_, ok := conf.Unmarshal(PortsKey, &ports).(ValidationError)
+	require.True(t, ok)
+
+	// Sections not in the file are not validated.
+	var device Device
+	require.NoError(t, conf.Unmarshal(DeviceKey, &device))
+	m := map[string]interface{}{}
+	require.NoError(t, conf.Unmarshal(PortsKey, &m))
+}
+
+func TestSectionDefaults(t *testing.T) {
+	defer newFs(t, "")()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+
+	var recorder ThermalRecorder
+	require.NoError(t, conf.Section(ThermalRecorderKey, &recorder))
+	require.Equal(t, DefaultThermalRecorder(), recorder)
+	require.Error(t, conf.Section(ThermalRecorderKey, &Windows{}))
+	require.Error(t, conf.Section(ThermalRecorderKey, recorder))
+
+	require.NoError(t, conf.SetField(ThermalRecorderKey, "max-secs", "60"))
+	expected := DefaultThermalRecorder()
+	expected.MaxSecs = 60
+	require.NoError(t, conf.Section(ThermalRecorderKey, &recorder))
+	require.Equal(t, expected, recorder)
+	var recorder2 ThermalRecorder
+	require.NoError(t, conf.Unmarshal(ThermalRecorderKey, &recorder2))
+	require.Equal(t, expected, recorder2)
+
+	isDefault, err := conf.IsDefault(ThermalRecorderKey, "max-secs")
+	require.NoError(t, err)
+	require.False(t, isDefault)
+	isDefault, err = conf.IsDefault(ThermalRecorderKey, "min-secs")
+	require.NoError(t, err)
+	require.True(t, isDefault)
+	_, err = conf.IsDefault(ThermalRecorderKey, "not-a-field")
+	require.Error(t, err)
+
+	defaults, err := conf.Defaults(ModemdKey)
+	require.NoError(t, err)
+	modemd := defaults.(Modemd)
+	modemd.Modems[0].Name = "changed"
+	defaults, err = conf.Defaults(ModemdKey)
+	require.NoError(t, err)
+	require.Equal(t, DefaultModemd(), defaults)
+
+	// A list in the file replaces the default list.
+	modems := []Modem{{Name: "a modem", NetDev: "wwan0"}}
+	require.NoError(t, conf.SetFromMap(ModemdKey, map[string]interface{}{
+		"modems": []map[string]interface{}{{"name": "a modem", "net-dev": "wwan0"}},
+	}))
+	require.NoError(t, conf.Section(ModemdKey, &modemd))
+	require.Equal(t, modems, modemd.Modems)
+
+	var device Device
+	require.NoError(t, conf.Section(DeviceKey, &device))
+	require.Equal(t, DefaultDevice(), device)
+}
+
+func TestRegisterSection(t *testing.T) {
+	defer newFs(t, "")()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+
+	require.Error(t, RegisterSection(customKey, custom{}))
+	require.Error(t, RegisterSection(WindowsKey, Windows{}))
+	require.Error(t, RegisterSection("not.valid", custom{}))
+	require.Error(t, RegisterSection("not-a-struct", 4))
+	require.Contains(t, SectionKeys(), customKey)
+	docs, err := FieldDocs(customKey)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"name": "name of the thing"}, docs)
+
+	require.NoError(t, conf.SetFromMap(customKey, map[string]interface{}{
+		"name":     "a name",
+		"interval": "2m",
+	}))
+	require.NoError(t, conf.SetField(customKey, "count", "3"))
+	require.Error(t, conf.SetField(customKey, "count", "-1"))
+	require.Error(t, conf.SetField(customKey, "not-a-field", "1"))
+
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	var c custom
+	require.NoError(t, conf.Unmarshal(customKey, &c))
+	require.Equal(t, custom{Name: "a name", Interval: 2 * time.Minute, Count: 3}, c)
+}
+
+func TestDecodeHookOnRead(t *testing.T) {
+	defer newFs(t, "")()
+	configFile := path.Join(DefaultConfigDir, ConfigFileName)
+	require.NoError(t, afero.WriteFile(fs, configFile, []byte("[hooked]\n  level = \"high\"\n"), 0644))
+
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	h, err := HookedSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, 10, h.Level)
+	var s hooked
+	require.NoError(t, conf.Section(hookedKey, &s))
+	require.Equal(t, 10, s.Level)
+	values, err := conf.SectionValues(hookedKey)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, values["level"])
+}
+
+func TestTypedSection(t *testing.T) {
+	defer newFs(t, "")()
+	watchInterval = time.Millisecond * 10
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	conf2, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+
+	windows, err := WindowsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, DefaultWindows(), windows)
+	defaults, err := ModemdSection.Defaults()
+	require.NoError(t, err)
+	require.Equal(t, DefaultModemd(), defaults)
+	require.Equal(t, LocationKey, LocationSection.Key())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := WindowsSection.Watch(ctx, conf)
+	require.NoError(t, err)
+
+	w := randomWindows()
+	require.NoError(t, WindowsSection.Save(conf2, w))
+	select {
+	case w2 := <-ch:
+		require.Equal(t, w, w2)
+	case <-time.After(time.Second):
+		t.Fatal("no change received")
+	}
+	require.NoError(t, conf.Update())
+	windows, err = WindowsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, w, windows)
+
+	_, err = RegisterTypedSection(customKey, custom{})
+	require.Error(t, err)
+	require.Error(t, TypedSection[custom]{}.Save(conf, custom{}))
+}
+
+func TestWatch(t *testing.T) {
+	defer newFs(t, "")()
+	watchInterval = time.Millisecond * 10
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+	conf2, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := conf.Watch(ctx, WindowsKey)
+	require.NoError(t, err)
+	_, err = conf.Watch(ctx, "not-a-section")
+	require.Error(t, err)
+
+	l := randomLocation()
+	require.NoError(t, conf2.Set(LocationKey, &l))
+	select {
+	case s := <-ch:
+		t.Fatalf("unexpected change: %v", s)
+	case <-time.After(watchInterval * 5):
+	}
+
+	w := randomWindows()
+	require.NoError(t, conf2.Set(WindowsKey, &w))
+	select {
+	case s := <-ch:
+		require.Equal(t, w, s)
+	case <-time.After(time.Second):
+		t.Fatal("no change received")
+	}
+
+	cancel()
+	_, ok := <-ch
+	require.False(t, ok)
+}
+
+func TestSetFieldPath(t *testing.T) {
+	defer newFs(t, "")()
+	newNow()
+	conf, err := New(DefaultConfigDir)
+	require.NoError(t, err)
+
+	require.NoError(t, conf.SetField(ModemdKey, "modems[1].net-dev", "wwan1"))
+	require.NoError(t, conf.SetField(ModemdKey, "modems[]", `{"name": "new modem", "net-dev": "ppp0"}`))
+	require.NoError(t, conf.SetField(ModemdKey, "modems[].net-dev", "ppp1"))
+	require.NoError(t, conf.RemoveField(ModemdKey, "modems[0]"))
+	require.NoError(t, conf.SetField(ModemdKey, "test-interval", "30s"))
+	require.NoError(t, conf.SetField(TestHostsKey, "urls[]", "9.9.9.9"))
+	require.NoError(t, conf.SetField(LocationKey, "timestamp", now().Format(TimeFormat)))
+
+	modemd := DefaultModemd()
+	modemd.TestInterval = 30 * time.Second
+	modemd.Modems = []Modem{
+		{Name: "Spark 3G modem", NetDev: "wwan1", VendorProductID: "19d2:1405"},
+		{Name: "new modem", NetDev: "ppp0"},
+		{NetDev: "ppp1"},
+	}
+	conf, err = New(DefaultConfigDir)
+	require.NoError(t, err)
+	modemd2, err := ModemdSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, modemd, modemd2)
+	isDefault, err := conf.IsDefault(ModemdKey, "find-modem-timeout")
+	require.NoError(t, err)
+	require.True(t, isDefault)
+
+	testHosts, err := TestHostsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.1.1.1", "8.8.8.8", "9.9.9.9"}, testHosts.URLs)
+	require.NoError(t, conf.SetField(TestHostsKey, "urls", "1.0.0.1,8.8.4.4"))
+	testHosts, err = TestHostsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.0.0.1", "8.8.4.4"}, testHosts.URLs)
+
+	location, err := LocationSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, now().Unix(), location.Timestamp.Unix())
+
+	require.Error(t, conf.SetField(ModemdKey, "modems[5].name", "a"))
+	require.Error(t, conf.SetField(ModemdKey, "modems[0].not-a-field", "a"))
+	require.Error(t, conf.SetField(ModemdKey, "modems[0]", "not json"))
+	require.Error(t, conf.SetField(ModemdKey, "modems[]", `{"not-a-field": 1}`))
+	require.Error(t, conf.SetField(ModemdKey, "test-interval", "soon"))
+	require.Error(t, conf.SetField(ModemdKey, "test-interval[0]", "1s"))
+	require.Error(t, conf.SetField(ModemdKey, "modems[x]", "a"))
+	require.Error(t, conf.RemoveField(ModemdKey, "modems"))
+	require.Error(t, conf.RemoveField(ModemdKey, "modems[10]"))
+}
+
+func checkWritingMap(
+	t *testing.T,
+	key string,
+	s, expected interface{},
+	m map[string]interface{},
+	conf *Config) {
+	require.NoError(t, conf.SetFromMap(key, m))
+	require.NoError(t, conf.Unmarshal(key, s))
+	require.Equal(t, expected, s)
+}
+
+func newFs(t *testing.T, configFile string) func() {
+	restoreGlobals(t)
+	fs := afero.NewMemMapFs()
+	SetFs(fs)
+	fsConfigFile := path.Join(DefaultConfigDir, ConfigFileName)
+	lockFileFunc, cleanupFunc := configtest.WriteConfigFromFile(t, configFile, fsConfigFile, fs)
+	SetLockFilePath(lockFileFunc)
+	return cleanupFunc
+}
+
+// restoreGlobals restores the globals that tests change when the test
+// finishes.
+func restoreGlobals(t *testing.T) {
+	oldFs, oldNow, oldLockFilePath := fs, now, lockFilePath
+	oldLockTimeout, oldLockRetryDelay := lockTimeout, lockRetryDelay
+	oldWatchInterval, oldHistorySize := watchInterval, historySize
+	t.Cleanup(func() {
+		fs, now, lockFilePath = oldFs, oldNow, oldLockFilePath
+		lockTimeout, lockRetryDelay = oldLockTimeout, oldLockRetryDelay
+		watchInterval, historySize = oldWatchInterval, oldHistorySize
+	})
+}
+
+func newNow() {
+	n := time.Now()
+	now = func() time.Time {
+		return n
+	}
+}
+
+func randomDevice() (d Device) {
+	fako.Fuzz(&d)
+	d.ID = int(randSrc.Int63() % 100000)
+	d.Server = "https://" + randString(10) + ".org"
+	return
+}
+
+func randomWindows() Windows {
+	return Windows{
+		StartRecording: randomWindowTime(),
+		StopRecording:  randomWindowTime(),
+		PowerOn:        randomWindowTime(),
+		PowerOff:       randomWindowTime(),
+	}
+}
+
+func randomWindowTime() string {
+	if randSrc.Int63()%2 == 0 {
+		return "+" + time.Duration(randSrc.Int63()%int64(time.Hour)).Truncate(time.Minute).String()
+	}
+	return time.Unix(randSrc.Int63()%86400, 0).UTC().Format("15:04")
 }
 
 func randomLocation() Location {
 	return Location{
-		Accuracy:  float32(randSrc.Int63()),
-		Longitude: float32(randSrc.Int63()),
+		Accuracy:  float32(randSrc.Int63() % 1000),
+		Latitude:  float32(randSrc.Int63()%180 - 90),
+		Longitude: float32(randSrc.Int63()%360 - 180),
 		Timestamp: now(),
 	}
 }
@@ -365,8 +1830,8 @@ func equalLocation(t *testing.T, l1, l2 Location) {
 func randomTestHosts() TestHosts {
 	return TestHosts{
 		URLs:         []string{randString(10), randString(20), randString(15)},
-		PingRetries:  int(randSrc.Int63()),
-		PingWaitTime: time.Duration(randSrc.Int63()) * time.Second,
+		PingRetries:  int(randSrc.Int63() % 100),
+		PingWaitTime: time.Duration(randSrc.Int63()%3600) * time.Second,
 	}
 }
 
@@ -0,0 +1,182 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package configdbus exports the cacophony config on D-Bus.
+package configdbus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	config "github.com/TheCacophonyProject/go-config"
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+)
+
+const (
+	DbusName      = "org.cacophony.config"
+	DbusPath      = "/org/cacophony/config"
+	DbusInterface = "org.cacophony.config"
+)
+
+// SectionChanged is the name of the signal sent with the section key when
+// a section in the config file changes.
+const SectionChanged = DbusInterface + ".SectionChanged"
+
+// writerUID is the user allowed to change the config.
+var writerUID uint32 = 0
+
+type service struct {
+	mu   sync.Mutex
+	conn *dbus.Conn
+	conf *config.Config
+}
+
+// Export exports conf on the D-Bus connection and requests DbusName. Locking
+// and validation are done by conf. SectionChanged signals are sent until ctx
+// is done.
+func Export(ctx context.Context, conn *dbus.Conn, conf *config.Config) error {
+	// Reading every section shouldn't make this service a dependency of them.
+	conf.RecordAccess = false
+	s := &service{conn: conn, conf: conf}
+	if err := conn.Export(s, DbusPath, DbusInterface); err != nil {
+		return err
+	}
+	node := &introspect.Node{
+		Name: DbusPath,
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			{
+				Name:    DbusInterface,
+				Methods: introspect.Methods(s),
+				Signals: []introspect.Signal{{
+					Name: "SectionChanged",
+					Args: []introspect.Arg{{Name: "section", Type: "s"}},
+				}},
+			},
+		},
+	}
+	if err := conn.Export(introspect.NewIntrospectable(node), DbusPath, "org.freedesktop.DBus.Introspectable"); err != nil {
+		return err
+	}
+
+	for _, key := range config.SectionKeys() {
+		ch, err := conf.Watch(ctx, key)
+		if err != nil {
+			return err
+		}
+		go func(key string, ch <-chan interface{}) {
+			for range ch {
+				conn.Emit(DbusPath, SectionChanged, key)
+			}
+		}(key, ch)
+	}
+
+	reply, err := conn.RequestName(DbusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return err
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return fmt.Errorf("name '%s' is already taken", DbusName)
+	}
+	return nil
+}
+
+// ListSections returns the keys of all the sections.
+func (s *service) ListSections() ([]string, *dbus.Error) {
+	return config.SectionKeys(), nil
+}
+
+// GetSection returns the section, with the values from the config file
+// layered over the defaults, as a JSON object. The values of secret sections
+// are redacted as any process can call this.
+func (s *service) GetSection(section string) (string, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.conf.Update(); err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	values, err := s.conf.RedactedSectionValues(section)
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	return string(b), nil
+}
+
+// checkWriter returns an error unless the sender is the user allowed to
+// change the config. The bus policy should also stop other users, this
+// checks in case the policy isn't installed.
+func (s *service) checkWriter(sender dbus.Sender) *dbus.Error {
+	var uid uint32
+	err := s.conn.BusObject().Call("org.freedesktop.DBus.GetConnectionUnixUser", 0, string(sender)).Store(&uid)
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	if uid != writerUID {
+		return dbus.NewError("org.freedesktop.DBus.Error.AccessDenied",
+			[]interface{}{fmt.Sprintf("user %d can not change the config", uid)})
+	}
+	return nil
+}
+
+// SetFields sets fields of the section from strings, keyed by the path of
+// the field as used by Config.SetField. The fields are only written if they
+// can all be set. Only root can call this.
+func (s *service) SetFields(sender dbus.Sender, section string, fields map[string]string) *dbus.Error {
+	if err := s.checkWriter(sender); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths := make([]string, 0, len(fields))
+	for path := range fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	err := s.conf.Transaction(func(tx *config.Tx) error {
+		for _, path := range paths {
+			if err := tx.SetField(section, path, fields[path]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+// Unset resets the fields of the section to their defaults, or the whole
+// section if no fields are given. Only root can call this.
+func (s *service) Unset(sender dbus.Sender, section string, fields []string) *dbus.Error {
+	if err := s.checkWriter(sender); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.conf.ResetToDefault(section, fields...); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package configdbus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	config "github.com/TheCacophonyProject/go-config"
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/require"
+)
+
+const busConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:tmpdir=%s</listen>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startBus starts a private dbus-daemon and returns its address. The test
+// is skipped if dbus-daemon is not installed.
+func startBus(t *testing.T, dir string) string {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+	configFile := path.Join(dir, "bus.conf")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(strings.Replace(busConfig, "%s", dir, 1)), 0644))
+	cmd := exec.Command(daemon, "--config-file="+configFile, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	return strings.TrimSpace(address)
+}
+
+func newTestConfig(t *testing.T, dir string) *config.Config {
+	conf, err := config.New(dir)
+	require.NoError(t, err)
+	conf.AuditSink = nil
+	return conf
+}
+
+func getSection(t *testing.T, obj dbus.BusObject, section string) map[string]interface{} {
+	var s string
+	require.NoError(t, obj.Call(DbusInterface+".GetSection", 0, section).Store(&s))
+	values := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(s), &values))
+	return values
+}
+
+// setWriterUID sets the user allowed to change the config for the test.
+func setWriterUID(t *testing.T, uid uint32) {
+	old := writerUID
+	writerUID = uid
+	t.Cleanup(func() { writerUID = old })
+}
+
+// startService exports a config in dir on a private bus and returns a
+// connection to the bus and the object of the service.
+func startService(t *testing.T, dir string) (*dbus.Conn, dbus.BusObject) {
+	address := startBus(t, dir)
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, config.ConfigFileName), nil, 0644))
+
+	conf := newTestConfig(t, dir)
+	serverConn, err := dbus.Connect(address)
+	require.NoError(t, err)
+	t.Cleanup(func() { serverConn.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	require.NoError(t, Export(ctx, serverConn, conf))
+
+	conn, err := dbus.Connect(address)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn, conn.Object(DbusName, DbusPath)
+}
+
+func TestService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configdbus")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	setWriterUID(t, uint32(os.Getuid()))
+	conn, obj := startService(t, dir)
+	require.NoError(t, conn.AddMatchSignal(
+		dbus.WithMatchInterface(DbusInterface),
+		dbus.WithMatchMember("SectionChanged"),
+	))
+	signals := make(chan *dbus.Signal, 20)
+	conn.Signal(signals)
+
+	var sections []string
+	require.NoError(t, obj.Call(DbusInterface+".ListSections", 0).Store(&sections))
+	require.Equal(t, config.SectionKeys(), sections)
+
+	require.Equal(t, "12:00", getSection(t, obj, config.WindowsKey)["power-on"])
+	fields := map[string]string{"power-on": "08:00", "stop-recording": "+2h"}
+	require.NoError(t, obj.Call(DbusInterface+".SetFields", 0, config.WindowsKey, fields).Err)
+	windows := getSection(t, obj, config.WindowsKey)
+	require.Equal(t, "08:00", windows["power-on"])
+	require.Equal(t, "+2h", windows["stop-recording"])
+
+	// None of the fields are set if one is not valid.
+	fields = map[string]string{"power-on": "09:00", "power-off": "not a time"}
+	require.Error(t, obj.Call(DbusInterface+".SetFields", 0, config.WindowsKey, fields).Err)
+	require.Equal(t, "08:00", getSection(t, obj, config.WindowsKey)["power-on"])
+	require.Error(t, obj.Call(DbusInterface+".GetSection", 0, "not-a-section").Err)
+	require.NoError(t, obj.Call(DbusInterface+".SetFields", 0, config.SecretsKey, map[string]string{"device-password": "pass"}).Err)
+	require.Equal(t, config.Redacted, getSection(t, obj, config.SecretsKey)["device-password"])
+
+	require.NoError(t, obj.Call(DbusInterface+".Unset", 0, config.WindowsKey, []string{"power-on"}).Err)
+	windows = getSection(t, obj, config.WindowsKey)
+	require.Equal(t, "12:00", windows["power-on"])
+	require.Equal(t, "+2h", windows["stop-recording"])
+
+	// Changes made outside of the service are picked up.
+	other := newTestConfig(t, dir)
+	require.NoError(t, other.SetField(config.AudioKey, "card", "2"))
+	require.Equal(t, float64(2), getSection(t, obj, config.AudioKey)["card"])
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case signal := <-signals:
+			if signal.Body[0] == config.AudioKey {
+				return
+			}
+		case <-timeout:
+			t.Fatal("no SectionChanged signal for the audio section")
+		}
+	}
+}
+
+func TestServiceRejectsOtherUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configdbus")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// The caller is not the user allowed to change the config.
+	setWriterUID(t, uint32(os.Getuid())+1)
+	_, obj := startService(t, dir)
+
+	fields := map[string]string{"device-password": "pass"}
+	err = obj.Call(DbusInterface+".SetFields", 0, config.SecretsKey, fields).Err
+	require.Error(t, err)
+	require.Equal(t, "org.freedesktop.DBus.Error.AccessDenied", err.(dbus.Error).Name)
+	err = obj.Call(DbusInterface+".Unset", 0, config.WindowsKey, []string{}).Err
+	require.Error(t, err)
+	require.Equal(t, "org.freedesktop.DBus.Error.AccessDenied", err.(dbus.Error).Name)
+
+	b, err := ioutil.ReadFile(path.Join(dir, config.ConfigFileName))
+	require.NoError(t, err)
+	require.Empty(t, b)
+	_, err = os.Stat(path.Join(dir, config.SecretsFileName))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,190 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package confighttp provides an HTTP handler for reading and editing the
+// cacophony config.
+package confighttp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	config "github.com/TheCacophonyProject/go-config"
+)
+
+var errStale = errors.New("section has changed since it was read")
+
+// requestError is an error in the change asked for by a request.
+type requestError struct {
+	error
+}
+
+type handler struct {
+	mu   sync.Mutex
+	conf *config.Config
+}
+
+// NewHandler returns a handler for the config with these endpoints, relative
+// to where it is mounted:
+//
+//	GET    /sections       the keys of all the sections
+//	GET    /sections/{key} the section as a JSON object, with an ETag
+//	PATCH  /sections/{key} apply a JSON merge patch to the section
+//	DELETE /sections/{key} reset the section to its defaults
+//
+// The ETag of a section is a hash of its values and the time it was last
+// updated, so it only changes when the section does. If a PATCH or DELETE has an If-Match header that doesn't match
+// the ETag, the section has been changed by someone else and 409 Conflict is
+// returned. Invalid changes return 400 Bad Request and failing to read or
+// write the config returns 500 Internal Server Error. The values of secret
+// sections are redacted.
+func NewHandler(conf *config.Config) http.Handler {
+	return &handler{conf: conf}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "sections" {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		writeJSON(w, http.StatusOK, config.SectionKeys())
+		return
+	}
+	key := strings.TrimPrefix(path, "sections/")
+	if key == path || strings.Contains(key, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if !isSectionKey(key) {
+		http.Error(w, "no section '"+key+"'", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.get(w, key)
+	case http.MethodPatch:
+		patch, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.write(w, r, key, func(tx *config.Tx) error {
+			return tx.Patch(key, patch)
+		})
+	case http.MethodDelete:
+		h.write(w, r, key, func(tx *config.Tx) error {
+			return tx.ResetToDefault(key)
+		})
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+func (h *handler) get(w http.ResponseWriter, key string) {
+	if err := h.conf.Update(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.writeSection(w, key)
+}
+
+// write makes the change in a transaction so the If-Match header is checked
+// against the section while the config is locked.
+func (h *handler) write(w http.ResponseWriter, r *http.Request, key string, f func(*config.Tx) error) {
+	ifMatch := r.Header.Get("If-Match")
+	err := h.conf.Transaction(func(tx *config.Tx) error {
+		if ifMatch != "" && ifMatch != "*" {
+			values, err := tx.SectionValues(key)
+			if err != nil {
+				return err
+			}
+			if ifMatch != etag(key, values, tx.Updated(key)) {
+				return errStale
+			}
+		}
+		if err := f(tx); err != nil {
+			return requestError{err}
+		}
+		return nil
+	})
+	var reqErr requestError
+	var validationErr config.ValidationError
+	switch {
+	case err == nil:
+		h.writeSection(w, key)
+	case err == errStale:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.As(err, &reqErr), errors.As(err, &validationErr):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *handler) writeSection(w http.ResponseWriter, key string) {
+	values, err := h.conf.SectionValues(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag(key, values, h.conf.Updated(key)))
+	writeJSON(w, http.StatusOK, config.RedactValues(key, values))
+}
+
+// etag makes the ETag of a section from its values and the time it was last
+// updated.
+func etag(key string, values map[string]interface{}, updated time.Time) string {
+	h := sha256.New()
+	// Map keys are sorted so this is the same for the same values. Secret
+	// sections are hashed redacted so the ETag doesn't give away a hash of
+	// the secrets, the update time still changes it when they change.
+	json.NewEncoder(h).Encode(config.RedactValues(key, values))
+	h.Write([]byte(updated.Format(time.RFC3339Nano)))
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+func isSectionKey(key string) bool {
+	for _, k := range config.SectionKeys() {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,163 @@
+package confighttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	config "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/go-config/configtest"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(NewHandler(newTestConfig(t)))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestConfig(t *testing.T) *config.Config {
+	fs := afero.NewMemMapFs()
+	config.SetFs(fs)
+	t.Cleanup(func() { config.SetFs(afero.NewOsFs()) })
+	configFile := path.Join(config.DefaultConfigDir, config.ConfigFileName)
+	lockFileFunc, cleanup := configtest.WriteConfigFromBytes(t, nil, configFile, fs)
+	t.Cleanup(cleanup)
+	config.SetLockFilePath(lockFileFunc)
+	conf, err := config.New(config.DefaultConfigDir)
+	require.NoError(t, err)
+	return conf
+}
+
+func do(t *testing.T, method, url, ifMatch, body string) (*http.Response, map[string]interface{}) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	values := map[string]interface{}{}
+	if resp.Header.Get("Content-Type") == "application/json" {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&values))
+	}
+	return resp, values
+}
+
+func TestListSections(t *testing.T) {
+	server := newTestServer(t)
+	resp, err := http.Get(server.URL + "/sections")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	sections := []string{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&sections))
+	require.Equal(t, config.SectionKeys(), sections)
+}
+
+func TestSection(t *testing.T) {
+	server := newTestServer(t)
+	url := server.URL + "/sections/" + config.WindowsKey
+
+	resp, windows := do(t, http.MethodGet, url, "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "12:00", windows["power-on"])
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+
+	resp, windows = do(t, http.MethodPatch, url, etag, `{"power-on": "08:00", "stop-recording": "+2h"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "08:00", windows["power-on"])
+	require.Equal(t, "+2h", windows["stop-recording"])
+	newETag := resp.Header.Get("ETag")
+	require.NotEqual(t, etag, newETag)
+
+	// The section has been changed since etag was read.
+	resp, _ = do(t, http.MethodPatch, url, etag, `{"power-on": "09:00"}`)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp, _ = do(t, http.MethodDelete, url, etag, "")
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp, _ = do(t, http.MethodPatch, url, newETag, `{"power-on": "not a time"}`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = do(t, http.MethodPatch, url, newETag, `{`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, windows = do(t, http.MethodGet, url, "", "")
+	require.Equal(t, "08:00", windows["power-on"])
+	require.Equal(t, newETag, resp.Header.Get("ETag"))
+
+	resp, windows = do(t, http.MethodDelete, url, newETag, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "12:00", windows["power-on"])
+	require.Equal(t, "+30m", windows["stop-recording"])
+}
+
+func TestWritesInTheSameSecond(t *testing.T) {
+	server := newTestServer(t)
+	url := server.URL + "/sections/" + config.WindowsKey
+
+	resp, _ := do(t, http.MethodPatch, url, "", `{"power-on": "08:00"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	resp, _ = do(t, http.MethodPatch, url, etag, `{"power-on": "09:00"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEqual(t, etag, resp.Header.Get("ETag"))
+	// The section was changed after etag was read, even if it was in the same second.
+	resp, _ = do(t, http.MethodPatch, url, etag, `{"power-on": "10:00"}`)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestETagAfterRestart(t *testing.T) {
+	conf := newTestConfig(t)
+	server := httptest.NewServer(NewHandler(conf))
+	defer server.Close()
+	resp, _ := do(t, http.MethodPatch, server.URL+"/sections/"+config.WindowsKey, "", `{"power-on": "08:00"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+
+	restarted := httptest.NewServer(NewHandler(conf))
+	defer restarted.Close()
+	url := restarted.URL + "/sections/" + config.WindowsKey
+	resp, _ = do(t, http.MethodGet, url, "", "")
+	require.Equal(t, etag, resp.Header.Get("ETag"))
+	resp, _ = do(t, http.MethodPatch, url, etag, `{"power-on": "09:00"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestWriteFailure(t *testing.T) {
+	server := newTestServer(t)
+	url := server.URL + "/sections/" + config.WindowsKey
+
+	config.SetFs(afero.NewReadOnlyFs(afero.NewMemMapFs()))
+	resp, _ := do(t, http.MethodPatch, url, "", `{"power-on": "08:00"}`)
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+func TestSecretsRedacted(t *testing.T) {
+	server := newTestServer(t)
+	url := server.URL + "/sections/" + config.SecretsKey
+
+	resp, secrets := do(t, http.MethodPatch, url, "", `{"device-password": "pass"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, config.Redacted, secrets["device-password"])
+	_, secrets = do(t, http.MethodGet, url, "", "")
+	require.Equal(t, config.Redacted, secrets["device-password"])
+}
+
+func TestBadRequests(t *testing.T) {
+	server := newTestServer(t)
+	resp, _ := do(t, http.MethodGet, server.URL+"/sections/not-a-section", "", "")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = do(t, http.MethodGet, server.URL+"/other", "", "")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = do(t, http.MethodPost, server.URL+"/sections/"+config.WindowsKey, "", "{}")
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	require.Equal(t, "GET, PATCH, DELETE", resp.Header.Get("Allow"))
+	resp, _ = do(t, http.MethodDelete, server.URL+"/sections", "", "")
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
@@ -0,0 +1,367 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package configsync syncs the device settings in the cacophony config with
+// the Cacophony API server.
+package configsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	config "github.com/TheCacophonyProject/go-config"
+)
+
+// DefaultQueueFile is where the local changes waiting to be pushed to the
+// server are kept.
+const DefaultQueueFile = "/var/lib/cacophony/config-sync.json"
+
+const updatedKey = "updated"
+
+// errUnauthorized is returned when the server rejects the token.
+var errUnauthorized = errors.New("not authorized by the server")
+
+// Syncer pushes local changes to the sections to the server and merges the
+// settings from the server into the config. A change is only applied if it
+// is newer than the last update of the section, as with StrictSet, so the
+// latest change made locally or on the server is kept.
+type Syncer struct {
+	conf      *config.Config
+	queueFile string
+	token     string
+	Client    *http.Client
+	Sections  []string // The sections that are synced.
+}
+
+// Result has the sections changed by a sync.
+type Result struct {
+	Pushed   []string         // Sections sent to the server.
+	Pulled   []string         // Sections updated from the server.
+	Rejected map[string]error // Sections from the server that couldn't be applied.
+}
+
+// change is a local change to a section waiting to be pushed.
+type change struct {
+	Section string                 `json:"section"`
+	Values  map[string]interface{} `json:"values"`
+	Updated time.Time              `json:"updated"`
+}
+
+// state is kept in the queue file so changes made while offline are pushed
+// when the server can be reached again.
+type state struct {
+	// Synced has the update time of each section when it was last pushed to
+	// or pulled from the server. A section updated after that has a local
+	// change to push.
+	Synced map[string]time.Time `json:"synced"`
+	Queue  []change             `json:"queue"`
+}
+
+// New returns a Syncer for conf that keeps its queue in queueFile. The
+// server and credentials are read from the device and secrets sections on
+// each sync. All sections are synced except for those and other secret
+// sections.
+func New(conf *config.Config, queueFile string) *Syncer {
+	sections := []string{}
+	for _, key := range config.SectionKeys() {
+		if key != config.DeviceKey && !config.IsSecretSection(key) {
+			sections = append(sections, key)
+		}
+	}
+	return &Syncer{
+		conf:      conf,
+		queueFile: queueFile,
+		Client:    &http.Client{Timeout: 30 * time.Second},
+		Sections:  sections,
+	}
+}
+
+// Sync queues the local changes made since the last sync, pushes the queue
+// to the server and then merges the settings from the server. If the
+// server can't be reached the queue is kept to be pushed by the next sync.
+// Sections from the server that are invalid are skipped and given in the
+// Rejected field of the result.
+func (s *Syncer) Sync(ctx context.Context) (*Result, error) {
+	if err := s.conf.Update(); err != nil {
+		return nil, err
+	}
+	st, err := s.readState()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.queueLocalChanges(st); err != nil {
+		return nil, err
+	}
+	if err := s.writeState(st); err != nil {
+		return nil, err
+	}
+
+	result := &Result{Rejected: map[string]error{}}
+	device, err := config.DeviceSection.Load(s.conf)
+	if err != nil {
+		return nil, err
+	}
+	if device.Server == "" || device.ID == 0 {
+		return nil, errors.New("the device is not registered with a server")
+	}
+	for len(st.Queue) > 0 {
+		c := st.Queue[0]
+		if err := s.push(ctx, device, c); err != nil {
+			return result, err
+		}
+		st.Queue = st.Queue[1:]
+		st.Synced[c.Section] = c.Updated
+		if err := s.writeState(st); err != nil {
+			return result, err
+		}
+		result.Pushed = append(result.Pushed, c.Section)
+	}
+
+	settings, err := s.fetch(ctx, device)
+	if err != nil {
+		return result, err
+	}
+	for _, key := range s.Sections {
+		values, ok := settings[key]
+		if !ok {
+			continue
+		}
+		updated, err := updateTime(values)
+		if err != nil {
+			result.Rejected[key] = err
+			continue
+		}
+		delete(values, updatedKey)
+		err = s.conf.StrictSetFromMap(key, values, updated)
+		if _, ok := err.(*config.StaleUpdateError); ok {
+			continue
+		} else if err != nil {
+			result.Rejected[key] = err
+			continue
+		}
+		st.Synced[key] = s.conf.Updated(key)
+		result.Pulled = append(result.Pulled, key)
+	}
+	return result, s.writeState(st)
+}
+
+// updateTime returns the time a section from the server was updated.
+func updateTime(values map[string]interface{}) (time.Time, error) {
+	updated, ok := values[updatedKey].(string)
+	if !ok {
+		return time.Time{}, errors.New("no update time given by the server")
+	}
+	return time.Parse(config.TimeFormat, updated)
+}
+
+// queueLocalChanges adds the sections updated since they were last synced
+// to the queue. A section already in the queue is replaced with its latest
+// values.
+func (s *Syncer) queueLocalChanges(st *state) error {
+	for _, key := range s.Sections {
+		updated := s.conf.Updated(key)
+		if updated.IsZero() || !updated.After(st.Synced[key]) {
+			continue
+		}
+		values, err := s.conf.SectionValues(key)
+		if err != nil {
+			return err
+		}
+		queue := st.Queue[:0]
+		for _, c := range st.Queue {
+			if c.Section != key {
+				queue = append(queue, c)
+			}
+		}
+		st.Queue = append(queue, change{Section: key, Values: values, Updated: updated})
+		st.Synced[key] = updated
+	}
+	return nil
+}
+
+func (s *Syncer) readState() (*state, error) {
+	st := &state{}
+	b, err := ioutil.ReadFile(s.queueFile)
+	if os.IsNotExist(err) {
+		st.Synced = map[string]time.Time{}
+		return st, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, fmt.Errorf("failed to read sync queue '%s': %v", s.queueFile, err)
+	}
+	if st.Synced == nil {
+		st.Synced = map[string]time.Time{}
+	}
+	return st, nil
+}
+
+// writeState writes the state to a temporary file that is synced and then
+// renamed, so the queue isn't lost if writing is interrupted or power is
+// lost.
+func (s *Syncer) writeState(st *state) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(s.queueFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp := s.queueFile + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.queueFile); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *Syncer) push(ctx context.Context, device config.Device, c change) error {
+	values := map[string]interface{}{updatedKey: c.Updated.Format(config.TimeFormat)}
+	for k, v := range c.Values {
+		values[k] = v
+	}
+	body := map[string]interface{}{
+		"settings": map[string]interface{}{c.Section: values},
+	}
+	return s.do(ctx, device, http.MethodPost, settingsURL(device), body, nil)
+}
+
+func (s *Syncer) fetch(ctx context.Context, device config.Device) (map[string]map[string]interface{}, error) {
+	var resp struct {
+		Settings map[string]map[string]interface{} `json:"settings"`
+	}
+	if err := s.do(ctx, device, http.MethodGet, settingsURL(device), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Settings, nil
+}
+
+// do sends the request with the token, authenticating first if there isn't
+// one. If the token is rejected it authenticates again and retries once.
+func (s *Syncer) do(ctx context.Context, device config.Device, method, url string, body, result interface{}) error {
+	for retried := false; ; retried = true {
+		if s.token == "" {
+			if err := s.authenticate(ctx, device); err != nil {
+				return err
+			}
+		}
+		err := s.request(ctx, method, url, s.token, body, result)
+		if err != errUnauthorized || retried {
+			return err
+		}
+		s.token = ""
+	}
+}
+
+// authenticate gets a token for the device with its password.
+func (s *Syncer) authenticate(ctx context.Context, device config.Device) error {
+	secrets, err := config.SecretsSection.Load(s.conf)
+	if err != nil {
+		return err
+	}
+	if secrets.DevicePassword == "" {
+		return errors.New("no device password to authenticate with")
+	}
+	body := map[string]interface{}{
+		"deviceId":   device.ID,
+		"devicename": device.Name,
+		"groupname":  device.Group,
+		"password":   secrets.DevicePassword,
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	url := strings.TrimSuffix(device.Server, "/") + "/authenticate_device"
+	if err := s.request(ctx, http.MethodPost, url, "", body, &resp); err != nil {
+		return fmt.Errorf("failed to authenticate with the server: %v", err)
+	}
+	if resp.Token == "" {
+		return errors.New("no token given by the server")
+	}
+	s.token = resp.Token
+	return nil
+}
+
+func (s *Syncer) request(ctx context.Context, method, url, token string, body, result interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errUnauthorized
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func settingsURL(device config.Device) string {
+	return fmt.Sprintf("%s/api/v1/devices/%d/settings", strings.TrimSuffix(device.Server, "/"), device.ID)
+}
@@ -0,0 +1,223 @@
+package configsync
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	config "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/go-config/configtest"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testPassword = "secret"
+	testToken    = "JWT test-token"
+)
+
+// fakeAPI is a stand-in for the Cacophony API server.
+type fakeAPI struct {
+	mu        sync.Mutex
+	offline   bool
+	expired   bool // The next request with a token is rejected.
+	authCount int
+	settings  map[string]map[string]interface{}
+}
+
+func (a *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.offline {
+		http.Error(w, "offline", http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Path == "/authenticate_device" {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["password"] != testPassword || body["deviceId"] != float64(1) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		a.authCount++
+		json.NewEncoder(w).Encode(map[string]string{"token": testToken})
+		return
+	}
+	if r.URL.Path != "/api/v1/devices/1/settings" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != testToken || a.expired {
+		a.expired = false
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{"settings": a.settings})
+	case http.MethodPost:
+		var body struct {
+			Settings map[string]map[string]interface{} `json:"settings"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for key, values := range body.Settings {
+			a.settings[key] = values
+		}
+	}
+}
+
+func (a *fakeAPI) section(key string) map[string]interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.settings[key]
+}
+
+func (a *fakeAPI) setOffline(offline bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.offline = offline
+}
+
+func newTestConfig(t *testing.T, server string) *config.Config {
+	fs := afero.NewMemMapFs()
+	config.SetFs(fs)
+	t.Cleanup(func() { config.SetFs(afero.NewOsFs()) })
+	configFile := path.Join(config.DefaultConfigDir, config.ConfigFileName)
+	lockFileFunc, cleanup := configtest.WriteConfigFromBytes(t, nil, configFile, fs)
+	t.Cleanup(cleanup)
+	config.SetLockFilePath(lockFileFunc)
+	conf, err := config.New(config.DefaultConfigDir)
+	require.NoError(t, err)
+	require.NoError(t, conf.Set(config.DeviceKey, config.Device{Group: "g", ID: 1, Name: "d", Server: server}))
+	require.NoError(t, conf.Set(config.SecretsKey, config.Secrets{DevicePassword: testPassword}))
+	return conf
+}
+
+func TestSync(t *testing.T) {
+	api := &fakeAPI{settings: map[string]map[string]interface{}{
+		config.ThermalRecorderKey: {"max-secs": 120, "updated": "2020-01-02T03:04:05Z"},
+		config.WindowsKey:         {"power-on": "01:00", "updated": "2020-01-02T03:04:05Z"},
+	}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	conf := newTestConfig(t, server.URL)
+	require.NoError(t, conf.SetField(config.WindowsKey, "power-on", "06:00"))
+	queueFile := filepath.Join(t.TempDir(), "sync.json")
+
+	result, err := New(conf, queueFile).Sync(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{config.WindowsKey}, result.Pushed)
+	require.Equal(t, []string{config.ThermalRecorderKey}, result.Pulled)
+	require.Equal(t, "06:00", api.section(config.WindowsKey)["power-on"])
+	require.Equal(t, conf.Updated(config.WindowsKey).Format(config.TimeFormat), api.section(config.WindowsKey)["updated"])
+	recorder, err := config.ThermalRecorderSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, 120, recorder.MaxSecs)
+	require.Nil(t, api.section(config.DeviceKey))
+	require.Nil(t, api.section(config.SecretsKey))
+
+	// Nothing has changed so nothing is pushed or pulled.
+	result, err = New(conf, queueFile).Sync(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, result.Pushed)
+	require.Empty(t, result.Pulled)
+}
+
+func TestSyncRejectsBadSections(t *testing.T) {
+	api := &fakeAPI{settings: map[string]map[string]interface{}{
+		config.AudioKey:    {"not-a-field": 1, "updated": "2020-01-02T03:04:05Z"},
+		config.LocationKey: {"latitude": 10},
+		config.WindowsKey:  {"power-on": "01:00", "updated": "2020-01-02T03:04:05Z"},
+	}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	conf := newTestConfig(t, server.URL)
+	queueFile := filepath.Join(t.TempDir(), "sync.json")
+
+	result, err := New(conf, queueFile).Sync(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{config.WindowsKey}, result.Pulled)
+	require.Len(t, result.Rejected, 2)
+	require.Contains(t, result.Rejected, config.AudioKey)
+	require.Contains(t, result.Rejected, config.LocationKey)
+	windows, err := config.WindowsSection.Load(conf)
+	require.NoError(t, err)
+	require.Equal(t, "01:00", windows.PowerOn)
+
+	// The pulled section isn't pushed back as a local change.
+	result, err = New(conf, queueFile).Sync(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, result.Pushed)
+}
+
+func TestSyncOffline(t *testing.T) {
+	api := &fakeAPI{settings: map[string]map[string]interface{}{}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	conf := newTestConfig(t, server.URL)
+	queueFile := filepath.Join(t.TempDir(), "sync.json")
+
+	api.setOffline(true)
+	require.NoError(t, conf.SetField(config.WindowsKey, "power-on", "06:00"))
+	_, err := New(conf, queueFile).Sync(context.Background())
+	require.Error(t, err)
+	st := readTestState(t, queueFile)
+	require.Len(t, st.Queue, 1)
+	require.Equal(t, "06:00", st.Queue[0].Values["power-on"])
+
+	// Later changes to a queued section replace it in the queue.
+	time.Sleep(time.Second)
+	require.NoError(t, conf.SetField(config.WindowsKey, "power-on", "07:00"))
+	_, err = New(conf, queueFile).Sync(context.Background())
+	require.Error(t, err)
+	st = readTestState(t, queueFile)
+	require.Len(t, st.Queue, 1)
+	require.Equal(t, "07:00", st.Queue[0].Values["power-on"])
+
+	// The queue is pushed when the server can be reached again.
+	api.setOffline(false)
+	result, err := New(conf, queueFile).Sync(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{config.WindowsKey}, result.Pushed)
+	require.Equal(t, "07:00", api.section(config.WindowsKey)["power-on"])
+	require.Empty(t, readTestState(t, queueFile).Queue)
+}
+
+func TestSyncReauthenticates(t *testing.T) {
+	api := &fakeAPI{settings: map[string]map[string]interface{}{}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	conf := newTestConfig(t, server.URL)
+	s := New(conf, filepath.Join(t.TempDir(), "sync.json"))
+
+	_, err := s.Sync(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, api.authCount)
+	api.expired = true
+	_, err = s.Sync(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, api.authCount)
+
+	require.NoError(t, conf.Set(config.SecretsKey, config.Secrets{DevicePassword: "wrong"}))
+	s.token = ""
+	_, err = s.Sync(context.Background())
+	require.Error(t, err)
+}
+
+func readTestState(t *testing.T, queueFile string) state {
+	b, err := ioutil.ReadFile(queueFile)
+	require.NoError(t, err)
+	var st state
+	require.NoError(t, json.Unmarshal(b, &st))
+	return st
+}
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"testing"
 
 	"github.com/spf13/afero"
@@ -11,20 +12,24 @@ import (
 )
 
 // WriteConfigFromBytes will write the config file in the given fs and return the
-// function setting the lockFile and a cleanup function
+// function setting the lockFile and a cleanup function. Each file, such as the
+// config file and the secrets file, gets its own lock file.
 func WriteConfigFromBytes(t *testing.T, configBytes []byte, fsConfigFile string, fs afero.Fs) (func(string) string, func()) {
 	if fs == nil {
 		fs = afero.NewMemMapFs()
 	}
 	require.NoError(t, afero.WriteFile(fs, fsConfigFile, configBytes, 0644))
 
-	lockFile := path.Join(os.TempDir(), fsConfigFile+".lock")
-	require.NoError(t, os.MkdirAll(path.Dir(lockFile), 0777))
+	lockDir := path.Join(os.TempDir(), path.Dir(fsConfigFile))
+	require.NoError(t, os.MkdirAll(lockDir, 0777))
 	return func(p string) string {
-			return lockFile
+			return path.Join(lockDir, path.Base(p)+".lock")
 		},
 		func() {
-			os.Remove(lockFile)
+			files, _ := filepath.Glob(path.Join(lockDir, "*.lock"))
+			for _, file := range files {
+				os.Remove(file)
+			}
 		}
 }
 
@@ -0,0 +1,21 @@
+package configtest
+
+import "sync"
+
+// FakeRestarter records the units it is asked to restart instead of
+// restarting them.
+type FakeRestarter struct {
+	mu        sync.Mutex
+	Restarted []string
+	Err       error
+}
+
+func (r *FakeRestarter) RestartUnit(unit string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	r.Restarted = append(r.Restarted, unit)
+	return nil
+}
@@ -0,0 +1,277 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Defaults returns a copy of the registered defaults of the section.
+func (c *Config) Defaults(key string) (interface{}, error) {
+	return sectionDefaults(key)
+}
+
+// Section decodes the section into out, which must be a pointer to the
+// section struct. Values in the config file are layered over the defaults
+// of the section.
+func (c *Config) Section(key string, out interface{}) error {
+	defaults, err := sectionDefaults(key)
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Type() != reflect.TypeOf(defaults) {
+		return fmt.Errorf("section '%s' must be decoded into a *%T, not a %T", key, defaults, out)
+	}
+	v.Elem().Set(reflect.ValueOf(defaults))
+	return c.Unmarshal(key, out)
+}
+
+// SectionValues returns the section, with the values in the config file
+// layered over the defaults, as a map keyed by the names used in the config
+// file. Durations and times are given as strings so the map can be encoded
+// as JSON. Reading a section this way is not recorded as an access of the
+// section.
+func (c *Config) SectionValues(key string) (map[string]interface{}, error) {
+	defaults, err := sectionDefaults(key)
+	if err != nil {
+		return nil, err
+	}
+	s := reflect.New(reflect.TypeOf(defaults))
+	s.Elem().Set(reflect.ValueOf(defaults))
+	if err := c.unmarshal(key, s.Interface(), false); err != nil {
+		return nil, err
+	}
+	m, err := interfaceToMap(s.Elem().Interface())
+	if err != nil {
+		return nil, err
+	}
+	return stringifyValues(m).(map[string]interface{}), nil
+}
+
+// Redacted replaces the values of secret sections when they are shown.
+const Redacted = "<redacted>"
+
+// RedactedSectionValues is SectionValues with the values of secret sections
+// redacted, for showing the section to callers that shouldn't see secrets.
+func (c *Config) RedactedSectionValues(key string) (map[string]interface{}, error) {
+	values, err := c.SectionValues(key)
+	if err != nil {
+		return nil, err
+	}
+	return RedactValues(key, values), nil
+}
+
+// RedactValues replaces the values from SectionValues with Redacted if the
+// section is a secret section.
+func RedactValues(key string, values map[string]interface{}) map[string]interface{} {
+	if !IsSecretSection(key) {
+		return values
+	}
+	redacted := make(map[string]interface{}, len(values))
+	for k := range values {
+		redacted[k] = Redacted
+	}
+	return redacted
+}
+
+// stringifyValues converts the durations and times in v to strings and the
+// keys of maps to lower case, as they are in the config file.
+func stringifyValues(v interface{}) interface{} {
+	switch value := v.(type) {
+	case time.Duration:
+		return value.String()
+	case time.Time:
+		return value.Format(TimeFormat)
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range value {
+			m[strings.ToLower(k)] = stringifyValues(e)
+		}
+		return m
+	case []map[string]interface{}:
+		l := make([]interface{}, len(value))
+		for i, e := range value {
+			l[i] = stringifyValues(e)
+		}
+		return l
+	case []interface{}:
+		l := make([]interface{}, len(value))
+		for i, e := range value {
+			l[i] = stringifyValues(e)
+		}
+		return l
+	}
+	return v
+}
+
+// IsDefault returns true if the field is not set in the config file, so
+// the default value of the field is used.
+func (c *Config) IsDefault(key, field string) (bool, error) {
+	defaults, err := sectionDefaults(key)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := structFields(reflect.TypeOf(defaults))[strings.ToLower(field)]; !ok {
+		return false, fmt.Errorf("'%s' is not a field in section '%s'", field, key)
+	}
+	return !c.view().IsSet(key + "." + field), nil
+}
+
+func sectionDefaults(key string) (interface{}, error) {
+	section, ok := allSections[key]
+	if !ok {
+		return nil, notSectionKeyError(key)
+	}
+	return deepCopy(reflect.ValueOf(section.defaults)).Interface(), nil
+}
+
+// fillDefaults sets raw to the defaults of the section if raw is a pointer
+// to the zero value of the section struct.
+func fillDefaults(key string, raw interface{}) {
+	section, ok := allSections[key]
+	if !ok {
+		return
+	}
+	v := reflect.ValueOf(raw)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Type() != reflect.TypeOf(section.defaults) {
+		return
+	}
+	zero := reflect.Zero(v.Elem().Type()).Interface()
+	if reflect.DeepEqual(v.Elem().Interface(), zero) {
+		v.Elem().Set(deepCopy(reflect.ValueOf(section.defaults)))
+	}
+}
+
+// clearSlices sets the slice fields of the struct pointed to by s to nil if
+// they are keys in m. Decoding into a slice that already has values will
+// only overwrite the first elements, but a list in the config file should
+// replace the list in the defaults.
+func clearSlices(s interface{}, m map[string]interface{}) {
+	v := reflect.ValueOf(s)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	fields := structFields(v.Elem().Type())
+	for k := range m {
+		field, ok := fields[strings.ToLower(k)]
+		if ok && field.Type.Kind() == reflect.Slice {
+			f := v.Elem().FieldByIndex(field.Index)
+			f.Set(reflect.Zero(f.Type()))
+		}
+	}
+}
+
+// decodeOverDefaults makes the section struct from the defaults of the
+// section with the values from m decoded over them.
+func decodeOverDefaults(key string, m map[string]interface{}) (interface{}, error) {
+	defaults, err := sectionDefaults(key)
+	if err != nil {
+		return nil, err
+	}
+	m = withoutLegacyKeys(key, m)
+	s := reflect.New(reflect.TypeOf(defaults))
+	s.Elem().Set(reflect.ValueOf(defaults))
+	clearSlices(s.Interface(), m)
+	if err := decodeStructFromMap(s.Interface(), m, allSections[key].decodeHook); err != nil {
+		return nil, err
+	}
+	return s.Elem().Interface(), nil
+}
+
+// valuesForKeys returns the values from the section struct s for only the
+// fields that are keys in m, in the form they are written to the file.
+func valuesForKeys(s interface{}, m map[string]interface{}) (map[string]interface{}, error) {
+	all, err := interfaceToMap(s)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]struct{}{}
+	for k := range m {
+		keys[strings.ToLower(k)] = struct{}{}
+	}
+	values := map[string]interface{}{}
+	for k, v := range all {
+		if _, ok := keys[strings.ToLower(k)]; ok {
+			values[k] = v
+		}
+	}
+	return values, nil
+}
+
+// structFields returns the fields of a section struct keyed by their
+// lower case name in the config file.
+func structFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("mapstructure"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		fields[strings.ToLower(name)] = field
+	}
+	return fields
+}
+
+// deepCopy copies v so the copy does not share any slices, maps or
+// pointers with v.
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, k := range v.MapKeys() {
+			c.SetMapIndex(k, deepCopy(v.MapIndex(k)))
+		}
+		return c
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(deepCopy(v.Elem()))
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(deepCopy(v.Field(i)))
+			}
+		}
+		return c
+	}
+	return v
+}
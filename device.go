@@ -16,13 +16,18 @@
 
 package config
 
+import "net/url"
+
 const DeviceKey = "device"
 
+var DeviceSection = TypedSection[Device]{key: DeviceKey}
+
 func init() {
 	allSections[DeviceKey] = section{
 		key:         DeviceKey,
 		mapToStruct: deviceMapToStruct,
-		validate:    noValidateFunc,
+		validate:    validateDevice,
+		defaults:    DefaultDevice(),
 	}
 }
 
@@ -33,6 +38,10 @@ type Device struct {
 	Server string
 }
 
+func DefaultDevice() Device {
+	return Device{}
+}
+
 func deviceMapToStruct(m map[string]interface{}) (interface{}, error) {
 	var s Device
 	if err := decodeStructFromMap(&s, m, nil); err != nil {
@@ -40,3 +49,21 @@ func deviceMapToStruct(m map[string]interface{}) (interface{}, error) {
 	}
 	return s, nil
 }
+
+func validateDevice(s interface{}) error {
+	d, ok := s.(Device)
+	if !ok {
+		return nil
+	}
+	errs := newFieldErrors(DeviceKey)
+	if d.ID < 0 {
+		errs.add("id", d.ID, "can not be negative")
+	}
+	if d.Server != "" {
+		u, err := url.Parse(d.Server)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("server", d.Server, "must be a http or https URL")
+		}
+	}
+	return errs.err()
+}
@@ -0,0 +1,82 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// EnvPrefix starts the names of the environment variables that override
+// fields, such as CACOPHONY_THERMAL_RECORDER_MAX_SECS.
+const EnvPrefix = "CACOPHONY"
+
+// BindEnv overrides fields with the values of the environment variables
+// named CACOPHONY_<SECTION>_<FIELD>, where the section and field are upper
+// case with '-' replaced by '_'. The values are decoded like values in the
+// config file so durations and times can be given as strings. They are
+// merged over all the files and are never written to the config file.
+func (c *Config) BindEnv() error {
+	layers, err := envLayers()
+	if err != nil {
+		return err
+	}
+	c.envLayers = layers
+	c.loadLayers()
+	return nil
+}
+
+// envLayers returns a layer for each environment variable that overrides a
+// field, sorted by variable name.
+func envLayers() ([]layer, error) {
+	layers := []layer{}
+	for key := range allSections {
+		defaults, err := sectionDefaults(key)
+		if err != nil {
+			return nil, err
+		}
+		for name, field := range structFields(reflect.TypeOf(defaults)) {
+			envVar := envVarName(key, name)
+			value, ok := os.LookupEnv(envVar)
+			if !ok {
+				continue
+			}
+			s, err := decodeOverDefaults(key, map[string]interface{}{name: value})
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %v", envVar, err)
+			}
+			layers = append(layers, layer{
+				file: envVar,
+				settings: map[string]interface{}{
+					key: map[string]interface{}{
+						name: reflect.ValueOf(s).FieldByIndex(field.Index).Interface(),
+					},
+				},
+			})
+		}
+	}
+	sort.Slice(layers, func(i, j int) bool { return layers[i].file < layers[j].file })
+	return layers, nil
+}
+
+func envVarName(sectionKey, field string) string {
+	name := EnvPrefix + "_" + sectionKey + "_" + field
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
@@ -1,13 +1,11 @@
 module github.com/TheCacophonyProject/go-config
 
-go 1.12
+go 1.18
 
 require (
 	github.com/alexflint/go-arg v1.1.0
-	github.com/corpix/uarand v0.1.1 // indirect
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/gofrs/flock v0.7.1
-	github.com/icrowley/fake v0.0.0-20180203215853-4178557ae428 // indirect
-	github.com/markbates/inflect v1.0.4 // indirect
 	github.com/mitchellh/mapstructure v1.1.2
 	github.com/pelletier/go-toml v1.2.0
 	github.com/spf13/afero v1.1.2
@@ -16,3 +14,23 @@ require (
 	github.com/wawandco/fako v0.0.0-20180828010250-c36a0bc97398
 	gopkg.in/yaml.v1 v1.0.0-20140924161607-9f9df34309c0
 )
+
+require (
+	github.com/alexflint/go-scalar v1.0.0 // indirect
+	github.com/corpix/uarand v0.1.1 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/fsnotify/fsnotify v1.4.7 // indirect
+	github.com/gobuffalo/envy v1.6.5 // indirect
+	github.com/hashicorp/hcl v1.0.0 // indirect
+	github.com/icrowley/fake v0.0.0-20180203215853-4178557ae428 // indirect
+	github.com/joho/godotenv v1.3.0 // indirect
+	github.com/magiconair/properties v1.8.0 // indirect
+	github.com/markbates/inflect v1.0.4 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/spf13/cast v1.3.0 // indirect
+	github.com/spf13/jwalterweatherman v1.0.0 // indirect
+	github.com/spf13/pflag v1.0.3 // indirect
+	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a // indirect
+	golang.org/x/text v0.3.0 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
+)
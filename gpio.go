@@ -18,11 +18,14 @@ package config
 
 const GPIOKey = "gpio"
 
+var GPIOSection = TypedSection[GPIO]{key: GPIOKey}
+
 func init() {
 	allSections[GPIOKey] = section{
 		key:         GPIOKey,
 		mapToStruct: gpioMapToStruct,
 		validate:    noValidateFunc,
+		defaults:    DefaultGPIO(),
 	}
 }
 
@@ -0,0 +1,297 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+
+	toml "github.com/pelletier/go-toml"
+)
+
+// historySize is the number of writes kept in the history.
+var historySize = 20
+
+// HistoryEntry describes a write to the config file.
+type HistoryEntry struct {
+	ID       int       `json:"id"`
+	Time     time.Time `json:"time"`
+	Sections []string  `json:"sections"`
+	Changes  []Change  `json:"changes"`
+	Process  string    `json:"process"`
+	PID      int       `json:"pid"`
+}
+
+// Change is a value in the config file that was added, changed or removed.
+// Old is nil for added values and New is nil for removed values.
+type Change struct {
+	Key string      `json:"key"`
+	Old interface{} `json:"old,omitempty"`
+	New interface{} `json:"new,omitempty"`
+}
+
+// historyRecord is what is stored in the history for each write. Snapshot
+// is the config file from before the write.
+type historyRecord struct {
+	HistoryEntry
+	Snapshot string `json:"snapshot"`
+}
+
+func historyDir(configFile string) string {
+	return configFile + ".history"
+}
+
+func historyFileName(id int) string {
+	return fmt.Sprintf("%08d.json.gz", id)
+}
+
+// History returns the writes to the config file that are kept in the
+// history, newest first.
+func (c *Config) History() ([]HistoryEntry, error) {
+	if err := c.fileLock.rlock(); err != nil {
+		return nil, err
+	}
+	defer c.fileLock.unlock()
+	records, err := readHistory(c.v.ConfigFileUsed())
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]HistoryEntry, len(records))
+	for i, record := range records {
+		entries[i] = record.HistoryEntry
+	}
+	return entries, nil
+}
+
+// Rollback restores the config file to how it was before the nth newest
+// write in the history, so Rollback(1) undoes the last write. The rollback
+// is written, and recorded in the history, like any other write.
+func (c *Config) Rollback(n int) error {
+	return c.mutate("Rollback", true, func() error {
+		records, err := readHistory(c.v.ConfigFileUsed())
+		if err != nil {
+			return err
+		}
+		if n < 1 || n > len(records) {
+			return fmt.Errorf("can not roll back %d writes, the history has %d", n, len(records))
+		}
+		tree, err := toml.Load(records[n-1].Snapshot)
+		if err != nil {
+			return err
+		}
+		// The secrets aren't in the history so the current ones are kept.
+		settings := tree.ToMap()
+		splitSecrets(settings)
+		for key, value := range splitSecrets(c.v.AllSettings()) {
+			settings[key] = value
+		}
+		return c.resetSettings(settings)
+	})
+}
+
+// recordHistory adds a write from old to new to the history of the config
+// file and removes the oldest writes past historySize. Secret sections in
+// old, from before they were moved to the secrets file, are left out.
+func recordHistory(configFile string, old, new []byte) error {
+	oldSettings, err := tomlToMap(old)
+	if err != nil {
+		return err
+	}
+	if len(splitSecrets(oldSettings)) > 0 {
+		tree, err := toml.TreeFromMap(oldSettings)
+		if err != nil {
+			return err
+		}
+		if old, err = tree.Marshal(); err != nil {
+			return err
+		}
+	}
+	newSettings, err := tomlToMap(new)
+	if err != nil {
+		return err
+	}
+	changes := DiffSettings(oldSettings, newSettings)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	dir := historyDir(configFile)
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	ids, err := historyIDs(dir)
+	if err != nil {
+		return err
+	}
+	id := 1
+	if len(ids) > 0 {
+		id = ids[len(ids)-1] + 1
+	}
+	record := historyRecord{
+		HistoryEntry: HistoryEntry{
+			ID:       id,
+			Time:     now(),
+			Sections: changedSections(changes),
+			Changes:  changes,
+			Process:  processName(),
+			PID:      os.Getpid(),
+		},
+		Snapshot: string(old),
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(record); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path.Join(dir, historyFileName(id)), buf.Bytes()); err != nil {
+		return err
+	}
+
+	ids = append(ids, id)
+	for len(ids) > historySize {
+		if err := fs.Remove(path.Join(dir, historyFileName(ids[0]))); err != nil {
+			return err
+		}
+		ids = ids[1:]
+	}
+	return nil
+}
+
+// readHistory returns the records in the history, newest first.
+func readHistory(configFile string) ([]historyRecord, error) {
+	dir := historyDir(configFile)
+	ids, err := historyIDs(dir)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]historyRecord, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		record, err := readHistoryRecord(path.Join(dir, historyFileName(ids[i])))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func readHistoryRecord(filename string) (historyRecord, error) {
+	var record historyRecord
+	f, err := fs.Open(filename)
+	if err != nil {
+		return record, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return record, err
+	}
+	defer zr.Close()
+	err = json.NewDecoder(zr).Decode(&record)
+	return record, err
+}
+
+// historyIDs returns the IDs of the records in the history directory in
+// ascending order.
+func historyIDs(dir string) ([]int, error) {
+	infos, err := afero.ReadDir(fs, dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	for _, info := range infos {
+		name := strings.TrimSuffix(info.Name(), ".json.gz")
+		id, err := strconv.Atoi(name)
+		if err != nil || name == info.Name() {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func tomlToMap(data []byte) (map[string]interface{}, error) {
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return tree.ToMap(), nil
+}
+
+// DiffSettings returns the changes from the old to the new settings, with
+// the keys of nested settings joined by '.', sorted by key.
+func DiffSettings(old, new map[string]interface{}) []Change {
+	oldValues := flattenSettings("", old, map[string]interface{}{})
+	newValues := flattenSettings("", new, map[string]interface{}{})
+	changes := []Change{}
+	for k, v := range oldValues {
+		if newValue, ok := newValues[k]; !ok {
+			changes = append(changes, Change{Key: k, Old: v})
+		} else if !reflect.DeepEqual(v, newValue) {
+			changes = append(changes, Change{Key: k, Old: v, New: newValue})
+		}
+	}
+	for k, v := range newValues {
+		if _, ok := oldValues[k]; !ok {
+			changes = append(changes, Change{Key: k, New: v})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
+
+func flattenSettings(prefix string, settings, values map[string]interface{}) map[string]interface{} {
+	for k, v := range settings {
+		if m, ok := v.(map[string]interface{}); ok {
+			flattenSettings(prefix+k+".", m, values)
+		} else {
+			values[prefix+k] = v
+		}
+	}
+	return values
+}
+
+// changedSections returns the top level keys of the changes.
+func changedSections(changes []Change) []string {
+	sections := []string{}
+	for _, change := range changes {
+		section := strings.Split(change.Key, ".")[0]
+		if len(sections) == 0 || sections[len(sections)-1] != section {
+			sections = append(sections, section)
+		}
+	}
+	return sections
+}
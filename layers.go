@@ -0,0 +1,187 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+const (
+	// VendorDefaultsFile has image wide defaults that config.toml overrides.
+	VendorDefaultsFile = "/usr/share/cacophony/defaults.toml"
+	// DropInDirName is the directory, in the config directory, of files that
+	// override config.toml. They are applied in lexical order.
+	DropInDirName = "config.d"
+	// OriginDefault is the origin of values that are not set in any file.
+	OriginDefault = "default"
+)
+
+// layer is a file with settings that are merged with config.toml.
+type layer struct {
+	file     string
+	settings map[string]interface{}
+}
+
+// loadLayers reads in the vendor defaults and drop in files. Files that
+// can't be read are skipped and reported in the warnings.
+func (c *Config) loadLayers() {
+	c.lowerLayers = nil
+	c.upperLayers = nil
+	c.layerWarnings = nil
+	if l, ok := c.readLayer(VendorDefaultsFile); ok {
+		c.lowerLayers = append(c.lowerLayers, l)
+	}
+	dropInDir := path.Join(path.Dir(c.v.ConfigFileUsed()), DropInDirName)
+	files, err := afero.Glob(fs, path.Join(dropInDir, "*.toml"))
+	if err != nil {
+		c.layerWarnings = append(c.layerWarnings, err)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		if l, ok := c.readLayer(file); ok {
+			c.upperLayers = append(c.upperLayers, l)
+		}
+	}
+	c.upperLayers = append(c.upperLayers, c.envLayers...)
+}
+
+func (c *Config) readLayer(file string) (layer, bool) {
+	data, err := afero.ReadFile(fs, file)
+	if err != nil {
+		if exists, _ := afero.Exists(fs, file); exists {
+			c.layerWarnings = append(c.layerWarnings, err)
+		}
+		return layer{}, false
+	}
+	v := viper.New()
+	v.SetConfigType("toml")
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		c.layerWarnings = append(c.layerWarnings, fmt.Errorf("skipped config file '%s': %v", file, err))
+		return layer{}, false
+	}
+	settings := v.AllSettings()
+	renameLegacyKeys(settings)
+	return layer{file: file, settings: settings}, true
+}
+
+// view returns the settings from all the layers merged together.
+func (c *Config) view() *viper.Viper {
+	if len(c.lowerLayers) == 0 && len(c.upperLayers) == 0 {
+		return c.v
+	}
+	settings := map[string]interface{}{}
+	for _, l := range c.lowerLayers {
+		mergeSettings(settings, l.settings)
+	}
+	mergeSettings(settings, c.v.AllSettings())
+	for _, l := range c.upperLayers {
+		mergeSettings(settings, l.settings)
+	}
+	v := viper.New()
+	v.MergeConfigMap(settings)
+	return v
+}
+
+// withLowerLayers returns the section map m from config.toml merged over
+// the section from the layers below config.toml.
+func (c *Config) withLowerLayers(sectionKey string, m map[string]interface{}) map[string]interface{} {
+	return mergeSectionLayers(sectionKey, c.lowerLayers, m, nil)
+}
+
+// mergeSectionLayers merges the section from the lower layers, m and then
+// the upper layers.
+func mergeSectionLayers(sectionKey string, lower []layer, m map[string]interface{}, upper []layer) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for _, l := range lower {
+		if s, ok := l.settings[sectionKey].(map[string]interface{}); ok {
+			mergeSettings(merged, s)
+		}
+	}
+	mergeSettings(merged, m)
+	for _, l := range upper {
+		if s, ok := l.settings[sectionKey].(map[string]interface{}); ok {
+			mergeSettings(merged, s)
+		}
+	}
+	return merged
+}
+
+// mergeSettings merges src into dst. Maps are merged and other values,
+// including lists, are replaced. Maps from src are copied.
+func mergeSettings(dst, src map[string]interface{}) {
+	for k, v := range src {
+		srcMap, ok := v.(map[string]interface{})
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		dstMap, ok := dst[k].(map[string]interface{})
+		if !ok {
+			dstMap = map[string]interface{}{}
+			dst[k] = dstMap
+		}
+		mergeSettings(dstMap, srcMap)
+	}
+}
+
+// Origin returns the file that the value of the field in the section comes
+// from, the environment variable if it is overridden by BindEnv, or
+// OriginDefault if the value is not set anywhere.
+func (c *Config) Origin(sectionKey, field string) (string, error) {
+	defaults, err := sectionDefaults(sectionKey)
+	if err != nil {
+		return "", err
+	}
+	field = strings.ToLower(field)
+	if _, ok := structFields(reflect.TypeOf(defaults))[field]; !ok {
+		return "", fmt.Errorf("'%s' is not a field in section '%s'", field, sectionKey)
+	}
+	for i := len(c.upperLayers) - 1; i >= 0; i-- {
+		if isSetIn(c.upperLayers[i].settings, sectionKey, field) {
+			return c.upperLayers[i].file, nil
+		}
+	}
+	if c.v.IsSet(sectionKey + "." + field) {
+		if IsSecretSection(sectionKey) {
+			return secretsFilePath(c.v.ConfigFileUsed()), nil
+		}
+		return c.v.ConfigFileUsed(), nil
+	}
+	for i := len(c.lowerLayers) - 1; i >= 0; i-- {
+		if isSetIn(c.lowerLayers[i].settings, sectionKey, field) {
+			return c.lowerLayers[i].file, nil
+		}
+	}
+	return OriginDefault, nil
+}
+
+func isSetIn(settings map[string]interface{}, sectionKey, field string) bool {
+	s, ok := settings[sectionKey].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = s[field]
+	return ok
+}
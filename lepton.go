@@ -18,11 +18,14 @@ package config
 
 const LeptonKey = "lepton"
 
+var LeptonSection = TypedSection[Lepton]{key: LeptonKey}
+
 func init() {
 	allSections[LeptonKey] = section{
 		key:         LeptonKey,
 		mapToStruct: leptonMapToStruct,
-		validate:    noValidateFunc,
+		validate:    validateLepton,
+		defaults:    DefaultLepton(),
 	}
 }
 
@@ -45,3 +48,15 @@ func leptonMapToStruct(m map[string]interface{}) (interface{}, error) {
 	}
 	return s, nil
 }
+
+func validateLepton(s interface{}) error {
+	l, ok := s.(Lepton)
+	if !ok {
+		return nil
+	}
+	errs := newFieldErrors(LeptonKey)
+	if l.SPISpeed < 0 {
+		errs.add("spi-speed", l.SPISpeed, "can not be negative")
+	}
+	return errs.err()
+}
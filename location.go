@@ -28,12 +28,15 @@ func init() {
 		key:         LocationKey,
 		mapToStruct: mapToLocation,
 		validate:    validateLocation,
+		defaults:    DefaultLocation(),
 	}
 	allSectionDecodeHookFuncs = append(allSectionDecodeHookFuncs, locationToMap)
 }
 
 const LocationKey = "location"
 
+var LocationSection = TypedSection[Location]{key: LocationKey}
+
 type Location struct {
 	Timestamp time.Time
 	Accuracy  float32
@@ -42,6 +45,11 @@ type Location struct {
 	Longitude float32
 }
 
+// DefaultLocation is used until the location of the device is known.
+func DefaultLocation() Location {
+	return Location{}
+}
+
 // Default location used when setting windows relative to sunset/sunrise
 func DefaultWindowLocation() Location {
 	return Location{
@@ -73,13 +81,26 @@ func mapToLocation(m map[string]interface{}) (interface{}, error) {
 	if err := decodeStructFromMap(&l, m, stringToTime); err != nil {
 		return nil, err
 	}
-	if err := validateLocation(&l); err != nil {
+	if err := validateLocation(l); err != nil {
 		return nil, err
 	}
 	return l, nil
 }
 
-//TODO
-func validateLocation(l interface{}) error {
-	return nil
+func validateLocation(s interface{}) error {
+	l, ok := s.(Location)
+	if !ok {
+		return nil
+	}
+	errs := newFieldErrors(LocationKey)
+	if l.Latitude < -90 || l.Latitude > 90 {
+		errs.add("latitude", l.Latitude, "must be between -90 and 90")
+	}
+	if l.Longitude < -180 || l.Longitude > 180 {
+		errs.add("longitude", l.Longitude, "must be between -180 and 180")
+	}
+	if l.Accuracy < 0 {
+		errs.add("accuracy", l.Accuracy, "can not be negative")
+	}
+	return errs.err()
 }
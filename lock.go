@@ -0,0 +1,133 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+var errNoFileLock = errors.New("failed to get lock on file")
+var errNotLocked = errors.New("file lock is not held")
+
+// ErrReadOnly is returned when trying to change a config opened with NewReadOnly.
+var ErrReadOnly = errors.New("config is read only")
+
+// fileLock is a re-entrant lock on the config file. flock will return
+// straight away if the lock is already held but the first unlock releases
+// it, so the lock depth is tracked here so that only the outermost unlock
+// releases the file lock. Readers take a shared lock and writers take an
+// exclusive lock, a shared lock is upgraded if an exclusive lock is needed.
+type fileLock struct {
+	flock     *flock.Flock
+	mu        sync.Mutex
+	depth     int
+	exclusive bool
+	readOnly  bool
+}
+
+func newFileLock(path string, readOnly bool) *fileLock {
+	return &fileLock{
+		flock:    flock.New(path),
+		readOnly: readOnly,
+	}
+}
+
+// lock takes the exclusive lock.
+func (l *fileLock) lock() error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
+	return l.acquire(true)
+}
+
+// tryLockOnce takes the exclusive lock without waiting for it.
+// errNoFileLock is returned if another process holds the lock.
+func (l *fileLock) tryLockOnce() error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.depth == 0 || !l.exclusive {
+		locked, err := l.flock.TryLock()
+		if err != nil {
+			return err
+		} else if !locked {
+			return errNoFileLock
+		}
+		l.exclusive = true
+	}
+	l.depth++
+	return nil
+}
+
+// rlock takes the shared lock. In read only mode, reading will carry on
+// without a lock if the lock file can't be opened.
+func (l *fileLock) rlock() error {
+	return l.acquire(false)
+}
+
+func (l *fileLock) acquire(exclusive bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.depth == 0 || (exclusive && !l.exclusive) {
+		lockFunc := l.flock.TryRLockContext
+		if exclusive {
+			lockFunc = l.flock.TryLockContext
+		}
+		if err := tryLock(lockFunc); err != nil {
+			if _, ok := err.(*os.PathError); !ok || !l.readOnly {
+				return err
+			}
+		}
+		l.exclusive = exclusive
+	}
+	l.depth++
+	return nil
+}
+
+func (l *fileLock) unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.depth == 0 {
+		return errNotLocked
+	}
+	l.depth--
+	if l.depth == 0 {
+		l.exclusive = false
+		return l.flock.Unlock()
+	}
+	return nil
+}
+
+func tryLock(lockFunc func(context.Context, time.Duration) (bool, error)) error {
+	lockCtx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	locked, err := lockFunc(lockCtx, lockRetryDelay)
+	if err != nil {
+		return err
+	} else if !locked {
+		return errNoFileLock
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// SchemaVersionKey is the top level key in the config file holding the
+// version of the schema the file was written with.
+const SchemaVersionKey = "schema-version"
+
+// migration changes the raw settings of a config file from the schema
+// version before it to the next.
+type migration func(settings map[string]interface{}) error
+
+// migrations are run in order on a config file. The migration at index i
+// moves a file from schema version i to version i+1, so new migrations must
+// only be added to the end.
+var migrations = []migration{
+	migrateDynamicThreshold,
+	moveSecrets,
+}
+
+// SchemaVersion returns the version of the config file schema used by this
+// package.
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// SchemaVersionError is a warning from New when the config file was written
+// with a newer schema version than this package knows about.
+type SchemaVersionError struct {
+	Version int
+}
+
+func (e *SchemaVersionError) Error() string {
+	return fmt.Sprintf("config file schema version %d is newer than the supported version %d", e.Version, SchemaVersion())
+}
+
+// Migrate runs any pending migrations on the config file in dir. If dryRun
+// is true the config file is not changed. The settings in the config file
+// before and after the migrations are returned. Secret sections are left out
+// of after, as they are kept in the secrets file, so moving them out of the
+// config file shows as removing them. Their values are redacted in before.
+func Migrate(dir string, dryRun bool) (before, after map[string]interface{}, err error) {
+	configFile := path.Join(dir, ConfigFileName)
+	v := viper.New()
+	v.SetFs(fs)
+	v.SetConfigFile(configFile)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, nil, err
+	}
+	newFunc := New
+	if dryRun {
+		newFunc = NewReadOnly
+	}
+	c, err := newFunc(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	before, after = v.AllSettings(), c.v.AllSettings()
+	for key, values := range splitSecrets(before) {
+		if m, ok := values.(map[string]interface{}); ok {
+			before[key] = RedactValues(key, m)
+		}
+	}
+	splitSecrets(after)
+	return before, after, nil
+}
+
+// migrate runs any pending migrations on the config that has been read in.
+// Unless the config is read only, the config file from before is kept with
+// the schema version as a suffix and the migrated config is written.
+func (c *Config) migrate() error {
+	version := c.v.GetInt(SchemaVersionKey)
+	if version > SchemaVersion() {
+		c.warnings = append(c.warnings, &SchemaVersionError{Version: version})
+		return nil
+	}
+	if version == SchemaVersion() || len(c.v.AllKeys()) == 0 {
+		return nil
+	}
+	if c.fileLock.readOnly {
+		return c.runMigrations()
+	}
+
+	if err := c.fileLock.lock(); err != nil {
+		return err
+	}
+	defer c.fileLock.unlock()
+	// Another process might have migrated the file already.
+	if err := c.readInConfig(); err != nil {
+		return err
+	}
+	version = c.v.GetInt(SchemaVersionKey)
+	if version >= SchemaVersion() {
+		return nil
+	}
+	configFile := c.v.ConfigFileUsed()
+	data, err := afero.ReadFile(fs, configFile)
+	if err != nil {
+		return err
+	}
+	backupFile := fmt.Sprintf("%s.schema-%d", configFile, version)
+	var mode os.FileMode = defaultConfigFileMode
+	if settings, err := tomlToMap(data); err != nil || len(splitSecrets(settings)) > 0 {
+		mode = secretsFileMode // The backup of a file with secrets should be as private as the secrets file.
+	}
+	if err := afero.WriteFile(fs, backupFile, data, mode); err != nil {
+		return err
+	}
+	if err := c.runMigrations(); err != nil {
+		return err
+	}
+	return c.writeConfig()
+}
+
+func (c *Config) runMigrations() error {
+	settings := c.v.AllSettings()
+	version := c.v.GetInt(SchemaVersionKey)
+	for i := version; i < SchemaVersion(); i++ {
+		if err := migrations[i](settings); err != nil {
+			return fmt.Errorf("failed to migrate config to schema version %d: %v", i+1, err)
+		}
+	}
+	settings[SchemaVersionKey] = SchemaVersion()
+	return c.resetSettings(settings)
+}
+
+// renameKey moves the value of the old key in the section to the new key.
+// The value of the new key is kept if it is already set. It returns true if
+// the old key was in the section.
+func renameKey(settings map[string]interface{}, sectionKey, oldKey, newKey string) bool {
+	m, ok := settings[sectionKey].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	value, ok := m[oldKey]
+	if !ok {
+		return false
+	}
+	delete(m, oldKey)
+	if _, ok := m[newKey]; !ok {
+		m[newKey] = value
+	}
+	return true
+}
+
+// renameLegacyKeys renames the legacy keys of every section in settings. It
+// returns true if any keys were renamed.
+func renameLegacyKeys(settings map[string]interface{}) bool {
+	renamed := false
+	for sectionKey, section := range allSections {
+		for oldKey, newKey := range section.legacyKeys {
+			if renameKey(settings, sectionKey, oldKey, newKey) {
+				renamed = true
+			}
+		}
+	}
+	return renamed
+}
+
+// withoutLegacyKeys returns a copy of the section map m with the legacy keys
+// of the section renamed.
+func withoutLegacyKeys(sectionKey string, m map[string]interface{}) map[string]interface{} {
+	section := map[string]interface{}{}
+	for k, v := range m {
+		section[k] = v
+	}
+	settings := map[string]interface{}{sectionKey: section}
+	for oldKey, newKey := range allSections[sectionKey].legacyKeys {
+		renameKey(settings, sectionKey, oldKey, newKey)
+	}
+	return section
+}
+
+// migrateDynamicThreshold moves thermal-motion.min-secs, which was the key
+// ThermalMotion.DynamicThreshold was read from by mistake, to
+// thermal-motion.dynamic-threshold.
+func migrateDynamicThreshold(settings map[string]interface{}) error {
+	renameKey(settings, ThermalMotionKey, "min-secs", "dynamic-threshold")
+	return nil
+}
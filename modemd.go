@@ -17,6 +17,7 @@
 package config
 
 import (
+	"fmt"
 	"reflect"
 	"time"
 
@@ -25,11 +26,14 @@ import (
 
 const ModemdKey = "modemd"
 
+var ModemdSection = TypedSection[Modemd]{key: ModemdKey}
+
 func init() {
 	allSections[ModemdKey] = section{
 		key:         ModemdKey,
 		mapToStruct: modemdMapToStruct,
-		validate:    noValidateFunc,
+		validate:    validateModemd,
+		defaults:    DefaultModemd(),
 	}
 	allSectionDecodeHookFuncs = append(allSectionDecodeHookFuncs, modemdToMap)
 }
@@ -94,3 +98,32 @@ func modemdMapToStruct(m map[string]interface{}) (interface{}, error) {
 	}
 	return s, nil
 }
+
+func validateModemd(s interface{}) error {
+	m, ok := s.(Modemd)
+	if !ok {
+		return nil
+	}
+	errs := newFieldErrors(ModemdKey)
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"test-interval", m.TestInterval},
+		{"initial-on-duration", m.InitialOnDuration},
+		{"find-modem-timeout", m.FindModemTimeout},
+		{"connection-timeout", m.ConnectionTimeout},
+		{"request-on-duration", m.RequestOnDuration},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			errs.add(d.name, d.value, "can not be negative")
+		}
+	}
+	for i, modem := range m.Modems {
+		if modem.NetDev == "" {
+			errs.add(fmt.Sprintf("modems[%d].net-dev", i), modem.NetDev, "can not be empty")
+		}
+	}
+	return errs.err()
+}
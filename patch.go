@@ -0,0 +1,87 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Patch applies a JSON merge patch (RFC 7396) to the section. Fields set
+// to null in the patch are removed from the config file so their defaults
+// are used. The patched section is checked against the section struct and
+// validated before it is set.
+func (c *Config) Patch(sectionKey string, patch []byte) error {
+	return c.mutate("Patch", c.AutoWrite, func() error {
+		return c.patch(sectionKey, patch)
+	})
+}
+
+func (c *Config) patch(sectionKey string, patch []byte) error {
+	if !checkIfSectionKey(sectionKey) {
+		return notSectionKeyError(sectionKey)
+	}
+	var p interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return fmt.Errorf("invalid patch for '%s': %v", sectionKey, err)
+	}
+	if _, ok := p.(map[string]interface{}); !ok {
+		return fmt.Errorf("patch for '%s' must be a JSON object", sectionKey)
+	}
+	settings := c.v.AllSettings()
+	current, _ := settings[sectionKey].(map[string]interface{})
+	m := mergePatch(withoutUpdated(current), p).(map[string]interface{})
+	s, err := decodeOverDefaults(sectionKey, c.withLowerLayers(sectionKey, m))
+	if err != nil {
+		return err
+	}
+	if err := validateSection(sectionKey, s); err != nil {
+		return err
+	}
+	values, err := valuesForKeys(s, m)
+	if err != nil {
+		return err
+	}
+	values["updated"] = now()
+	settings[sectionKey] = values
+	return c.resetSettings(settings)
+}
+
+// mergePatch returns target with the merge patch applied. Keys are made
+// lower case to match the keys in the config file.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t := map[string]interface{}{}
+	if targetMap, ok := target.(map[string]interface{}); ok {
+		for k, v := range targetMap {
+			t[strings.ToLower(k)] = v
+		}
+	}
+	for k, v := range p {
+		k = strings.ToLower(k)
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
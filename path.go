@@ -0,0 +1,210 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// A field path is made of field names separated by '.'. A field that is a
+// list can be followed by an index, "modems[1].net-dev", or by "[]" to
+// append a new element to the list, "urls[]".
+type pathElem struct {
+	field    string
+	index    int
+	hasIndex bool
+	append   bool
+}
+
+var pathElemRegexp = regexp.MustCompile(`^([A-Za-z0-9_-]+)(?:\[(\d*)\])?$`)
+
+func parsePath(fieldPath string) ([]pathElem, error) {
+	elems := []pathElem{}
+	for _, part := range strings.Split(fieldPath, ".") {
+		match := pathElemRegexp.FindStringSubmatch(part)
+		if match == nil {
+			return nil, fmt.Errorf("'%s' is not a valid field path", fieldPath)
+		}
+		elem := pathElem{field: match[1]}
+		if strings.HasSuffix(part, "[]") {
+			elem.append = true
+		} else if match[2] != "" {
+			elem.hasIndex = true
+			elem.index, _ = strconv.Atoi(match[2])
+		}
+		elems = append(elems, elem)
+	}
+	return elems, nil
+}
+
+func (c *Config) setField(sectionKey, fieldPath, value string) error {
+	return c.updateField(sectionKey, fieldPath, func(elems []pathElem, s reflect.Value) error {
+		field, err := findField(s, elems)
+		if err != nil {
+			return err
+		}
+		return setFromString(field, value, fieldPath)
+	})
+}
+
+// RemoveField removes an element from a list in the section. The path must
+// end with the index of the element, e.g. "modems[1]".
+func (c *Config) RemoveField(sectionKey, fieldPath string) error {
+	return c.mutate("RemoveField", c.AutoWrite, func() error {
+		return c.removeField(sectionKey, fieldPath)
+	})
+}
+
+func (c *Config) removeField(sectionKey, fieldPath string) error {
+	return c.updateField(sectionKey, fieldPath, func(elems []pathElem, s reflect.Value) error {
+		last := elems[len(elems)-1]
+		if !last.hasIndex {
+			return fmt.Errorf("'%s' does not end with the index of a list element", fieldPath)
+		}
+		listElem := last
+		listElem.hasIndex = false
+		list, err := findField(s, append(elems[:len(elems)-1], listElem))
+		if err != nil {
+			return err
+		}
+		if list.Kind() != reflect.Slice {
+			return fmt.Errorf("'%s' is not a list", last.field)
+		}
+		if last.index >= list.Len() {
+			return indexError(last, list.Len())
+		}
+		newList := reflect.MakeSlice(list.Type(), 0, list.Len()-1)
+		newList = reflect.AppendSlice(newList, list.Slice(0, last.index))
+		newList = reflect.AppendSlice(newList, list.Slice(last.index+1, list.Len()))
+		list.Set(newList)
+		return nil
+	})
+}
+
+// updateField calls f with the section struct, made from the config file
+// values layered over the defaults, so f can change the field at the path.
+// The section is then validated and the top level field of the path is
+// written to the section. Other fields that are not in the file are left
+// out so they keep using the defaults.
+func (c *Config) updateField(sectionKey, fieldPath string, f func([]pathElem, reflect.Value) error) error {
+	if !checkIfSectionKey(sectionKey) {
+		return notSectionKeyError(sectionKey)
+	}
+	elems, err := parsePath(fieldPath)
+	if err != nil {
+		return err
+	}
+	m := map[string]interface{}{}
+	if err := c.v.UnmarshalKey(sectionKey, &m); err != nil {
+		return err
+	}
+	delete(m, "updated")
+	s, err := decodeOverDefaults(sectionKey, c.withLowerLayers(sectionKey, m))
+	if err != nil {
+		return err
+	}
+	sPtr := reflect.New(reflect.TypeOf(s))
+	sPtr.Elem().Set(reflect.ValueOf(s))
+	if err := f(elems, sPtr.Elem()); err != nil {
+		return err
+	}
+	if err := validateSection(sectionKey, sPtr.Interface()); err != nil {
+		return err
+	}
+	m[strings.ToLower(elems[0].field)] = nil
+	values, err := valuesForKeys(sPtr.Elem().Interface(), m)
+	if err != nil {
+		return err
+	}
+	c.set(sectionKey, values, now())
+	return nil
+}
+
+// findField returns the field at the path in the struct s. Elements are
+// appended to lists when the path asks for it.
+func findField(s reflect.Value, elems []pathElem) (reflect.Value, error) {
+	v := s
+	for _, elem := range elems {
+		if v.Kind() != reflect.Struct {
+			return v, fmt.Errorf("can not get field '%s' from a %s", elem.field, v.Type())
+		}
+		field, ok := structFields(v.Type())[strings.ToLower(elem.field)]
+		if !ok {
+			return v, fmt.Errorf("'%s' is not a field of %s", elem.field, v.Type())
+		}
+		v = v.FieldByIndex(field.Index)
+		if !elem.hasIndex && !elem.append {
+			continue
+		}
+		if v.Kind() != reflect.Slice {
+			return v, fmt.Errorf("'%s' is not a list", elem.field)
+		}
+		if elem.append {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			elem.index = v.Len() - 1
+		} else if elem.index >= v.Len() {
+			return v, indexError(elem, v.Len())
+		}
+		v = v.Index(elem.index)
+	}
+	return v, nil
+}
+
+func indexError(elem pathElem, length int) error {
+	return fmt.Errorf("index %d is out of range for '%s' with %d elements", elem.index, elem.field, length)
+}
+
+// setFromString converts value to the type of the field and sets it.
+// Lists of strings can be given as comma separated values. Structs and
+// lists of structs are given as JSON.
+func setFromString(field reflect.Value, value, fieldPath string) error {
+	var data interface{} = value
+	t := field.Type()
+	isStructList := t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct
+	if (t.Kind() == reflect.Struct && t != timeType) || isStructList || t.Kind() == reflect.Map {
+		if err := json.Unmarshal([]byte(value), &data); err != nil {
+			return fmt.Errorf("'%s' needs a JSON value: %v", fieldPath, err)
+		}
+	}
+	result := reflect.New(t)
+	decoderConfig := mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			stringToDuration,
+			stringToTime,
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		Result:           result.Interface(),
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+	}
+	decoder, err := mapstructure.NewDecoder(&decoderConfig)
+	if err != nil {
+		return err
+	}
+	if err := decoder.Decode(data); err != nil {
+		return fmt.Errorf("can not use '%s' for '%s' (%s): %v", value, fieldPath, t, err)
+	}
+	field.Set(result.Elem())
+	return nil
+}
@@ -18,11 +18,14 @@ package config
 
 const PortsKey = "ports"
 
+var PortsSection = TypedSection[Ports]{key: PortsKey}
+
 func init() {
 	allSections[PortsKey] = section{
 		key:         PortsKey,
 		mapToStruct: portsMapToStruct,
-		validate:    noValidateFunc,
+		validate:    validatePorts,
+		defaults:    DefaultPorts(),
 	}
 }
 
@@ -43,3 +46,15 @@ func portsMapToStruct(m map[string]interface{}) (interface{}, error) {
 	}
 	return s, nil
 }
+
+func validatePorts(s interface{}) error {
+	p, ok := s.(Ports)
+	if !ok {
+		return nil
+	}
+	errs := newFieldErrors(PortsKey)
+	if p.Managementd < 1 || p.Managementd > 65535 {
+		errs.add("managementd", p.Managementd, "must be between 1 and 65535")
+	}
+	return errs.err()
+}
@@ -0,0 +1,126 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+const brokenTimeFormat = "20060102-150405"
+
+// RecoveredError is a warning from New when the config file could not be
+// parsed and the last known good copy was loaded in its place.
+type RecoveredError struct {
+	BrokenFile string
+	Err        error
+}
+
+func (e *RecoveredError) Error() string {
+	return fmt.Sprintf("failed to parse config file (%v), loaded last known good config, broken file is at '%s'",
+		e.Err, e.BrokenFile)
+}
+
+func goodFilePath(configFile string) string {
+	return configFile + ".good"
+}
+
+// updateGoodFile saves data as the last known good config.
+func updateGoodFile(configFile string, data []byte) error {
+	return writeFileAtomic(goodFilePath(configFile), data)
+}
+
+// seedGoodFile makes a last known good copy of the config file if there is
+// not one already. It is done under the lock, after any migrations, so the
+// copy is of a complete config file without the secret sections. Only one
+// attempt is made to take the lock, so New doesn't wait for other processes
+// reading the config. If the lock is held the copy is left for a later New
+// or write to make.
+func (c *Config) seedGoodFile() error {
+	if c.fileLock.readOnly {
+		return nil
+	}
+	configFile := c.v.ConfigFileUsed()
+	if _, err := fs.Stat(goodFilePath(configFile)); !os.IsNotExist(err) {
+		return err
+	}
+	if err := c.fileLock.tryLockOnce(); err != nil {
+		return err
+	}
+	defer c.fileLock.unlock()
+	// Another process might have made the copy before the lock was taken.
+	if _, err := fs.Stat(goodFilePath(configFile)); !os.IsNotExist(err) {
+		return err
+	}
+	data, err := afero.ReadFile(fs, configFile)
+	if err != nil {
+		return err
+	}
+	return updateGoodFile(configFile, data)
+}
+
+// recoverConfig loads the last known good config in place of a config file
+// that could not be parsed. Unless the config is read only, the good config
+// is written to the config file and the broken file is kept with a timestamp
+// suffix. parseErr is returned if there is no good config to recover.
+func (c *Config) recoverConfig(parseErr error) error {
+	configFile := c.v.ConfigFileUsed()
+	good, err := afero.ReadFile(fs, goodFilePath(configFile))
+	if err != nil {
+		return parseErr
+	}
+	if err := c.v.ReadConfig(bytes.NewReader(good)); err != nil {
+		return parseErr
+	}
+	if err := c.readSecrets(); err != nil {
+		return err
+	}
+	c.loadLayers()
+	if c.fileLock.readOnly {
+		c.warnings = append(c.warnings, &RecoveredError{
+			BrokenFile: configFile,
+			Err:        parseErr,
+		})
+		return nil
+	}
+
+	broken, err := afero.ReadFile(fs, configFile)
+	if err != nil {
+		return err
+	}
+	brokenFile := configFile + ".broken-" + now().Format(brokenTimeFormat)
+	if err := afero.WriteFile(fs, brokenFile, broken, defaultConfigFileMode); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(configFile, good); err != nil {
+		return err
+	}
+	c.warnings = append(c.warnings, &RecoveredError{
+		BrokenFile: brokenFile,
+		Err:        parseErr,
+	})
+	return nil
+}
+
+// Warnings returns problems New was able to recover from. These should be
+// logged by the caller.
+func (c *Config) Warnings() []error {
+	return append(c.warnings[:len(c.warnings):len(c.warnings)], c.layerWarnings...)
+}
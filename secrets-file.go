@@ -0,0 +1,152 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+
+	toml "github.com/pelletier/go-toml"
+)
+
+// SecretsFileName is the file, in the config directory, that the secret
+// sections are kept in instead of config.toml. Only its owner can read it.
+const SecretsFileName = "secrets.toml"
+
+const secretsFileMode = 0600
+
+// SecretsError is returned when reading a secret section if the secrets
+// file can't be read, usually because the caller isn't privileged.
+type SecretsError struct {
+	File string
+	Err  error
+}
+
+func (e *SecretsError) Error() string {
+	return fmt.Sprintf("can not read secrets file '%s': %v", e.File, e.Err)
+}
+
+func secretsFilePath(configFile string) string {
+	return path.Join(path.Dir(configFile), SecretsFileName)
+}
+
+// readSecrets merges the secret sections from the secrets file into the
+// settings. If the file can't be read because of its permissions the error
+// is kept to be returned when a secret section is read.
+func (c *Config) readSecrets() error {
+	c.secretsErr = nil
+	secretsFile := secretsFilePath(c.v.ConfigFileUsed())
+	if err := c.secretsLock.rlock(); err != nil {
+		if os.IsPermission(err) {
+			c.secretsErr = &SecretsError{File: secretsFile, Err: err}
+			return nil
+		}
+		return err
+	}
+	defer c.secretsLock.unlock()
+	data, err := afero.ReadFile(fs, secretsFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if os.IsPermission(err) {
+		c.secretsErr = &SecretsError{File: secretsFile, Err: err}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	v := viper.New()
+	v.SetConfigType("toml")
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to parse secrets file '%s': %v", secretsFile, err)
+	}
+	secrets := splitSecrets(v.AllSettings())
+	if len(secrets) == 0 {
+		return nil
+	}
+	return c.v.MergeConfigMap(secrets)
+}
+
+// splitSecrets removes the secret sections from settings and returns them.
+func splitSecrets(settings map[string]interface{}) map[string]interface{} {
+	secrets := map[string]interface{}{}
+	for key, value := range settings {
+		if IsSecretSection(key) {
+			secrets[key] = value
+			delete(settings, key)
+		}
+	}
+	return secrets
+}
+
+// writeSecrets writes the secret sections to the secrets file if they have
+// changed. The file is always written with secretsFileMode. The returned
+// function puts the old secrets file back, so the secrets can be kept as
+// they were if writing the rest of the config fails.
+func (c *Config) writeSecrets(secrets map[string]interface{}) (func() error, error) {
+	noop := func() error { return nil }
+	if err := c.secretsLock.lock(); err != nil {
+		return nil, err
+	}
+	defer c.secretsLock.unlock()
+	var buf bytes.Buffer
+	if len(secrets) > 0 {
+		tomlTree, err := toml.TreeFromMap(secrets)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tomlTree.WriteTo(&buf); err != nil {
+			return nil, err
+		}
+	}
+	secretsFile := secretsFilePath(c.v.ConfigFileUsed())
+	old, err := afero.ReadFile(fs, secretsFile)
+	existed := err == nil
+	if os.IsNotExist(err) {
+		if len(secrets) == 0 {
+			return noop, nil
+		}
+	} else if err != nil {
+		return nil, err
+	} else if bytes.Equal(old, buf.Bytes()) {
+		return noop, nil
+	}
+	if err := writeFileAtomicMode(secretsFile, buf.Bytes(), secretsFileMode); err != nil {
+		return nil, err
+	}
+	restore := func() error {
+		if err := c.secretsLock.lock(); err != nil {
+			return err
+		}
+		defer c.secretsLock.unlock()
+		if !existed {
+			return fs.Remove(secretsFile)
+		}
+		return writeFileAtomicMode(secretsFile, old, secretsFileMode)
+	}
+	return restore, nil
+}
+
+// moveSecrets is the migration for moving the secret sections out of
+// config.toml. They are moved to the secrets file when the migrated config
+// is written, so this only makes sure older config files are rewritten.
+func moveSecrets(settings map[string]interface{}) error {
+	return nil
+}
@@ -18,11 +18,15 @@ package config
 
 const SecretsKey = "secrets"
 
+var SecretsSection = TypedSection[Secrets]{key: SecretsKey}
+
 func init() {
 	allSections[SecretsKey] = section{
 		key:         SecretsKey,
 		mapToStruct: secretsMapToStruct,
 		validate:    noValidateFunc,
+		defaults:    DefaultSecrets(),
+		secret:      true,
 	}
 }
 
@@ -30,6 +34,10 @@ type Secrets struct {
 	DevicePassword string `mapstructure:"device-password"`
 }
 
+func DefaultSecrets() Secrets {
+	return Secrets{}
+}
+
 func secretsMapToStruct(m map[string]interface{}) (interface{}, error) {
 	var s Secrets
 	if err := decodeStructFromMap(&s, m, nil); err != nil {
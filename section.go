@@ -0,0 +1,152 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// SectionOption sets an optional part of a section added by RegisterSection.
+type SectionOption func(*sectionOptions)
+
+type sectionOptions struct {
+	decodeHook mapstructure.DecodeHookFunc
+	toMapHook  mapstructure.DecodeHookFunc
+	validate   func(interface{}) error
+	docs       map[string]string
+	secret     bool
+}
+
+// WithDecodeHook adds a decode hook used when making the section struct
+// from a map. Durations and times are already handled.
+func WithDecodeHook(hook mapstructure.DecodeHookFunc) SectionOption {
+	return func(o *sectionOptions) {
+		o.decodeHook = hook
+	}
+}
+
+// WithToMapHook adds a decode hook used when making a map from the section
+// struct before it is written, for example for slices of structs.
+func WithToMapHook(hook mapstructure.DecodeHookFunc) SectionOption {
+	return func(o *sectionOptions) {
+		o.toMapHook = hook
+	}
+}
+
+// WithValidator sets the function used to validate the section. It is given
+// the section struct, not a pointer to it.
+func WithValidator(validate func(interface{}) error) SectionOption {
+	return func(o *sectionOptions) {
+		o.validate = validate
+	}
+}
+
+// WithFieldDocs sets descriptions of the fields in the section, keyed by
+// the name of the field in the config file.
+func WithFieldDocs(docs map[string]string) SectionOption {
+	return func(o *sectionOptions) {
+		o.docs = docs
+	}
+}
+
+// WithSecret marks the values of the section as secret so they are
+// redacted when shown and kept in the secrets file instead of config.toml.
+func WithSecret() SectionOption {
+	return func(o *sectionOptions) {
+		o.secret = true
+	}
+}
+
+// RegisterSection adds a section to the config so it can be used in the
+// same way as the sections in this package. defaults is the struct for the
+// section, set to the default values. It should be called from an init
+// function as the sections are not safe to change while being used.
+func RegisterSection(key string, defaults interface{}, opts ...SectionOption) error {
+	if key == "" || strings.ContainsAny(key, ". ") {
+		return fmt.Errorf("'%s' is not a valid section key", key)
+	}
+	if checkIfSectionKey(key) {
+		return fmt.Errorf("section '%s' is already registered", key)
+	}
+	structType := reflect.TypeOf(defaults)
+	if structType == nil || structType.Kind() != reflect.Struct {
+		return fmt.Errorf("defaults for section '%s' must be a struct, not %T", key, defaults)
+	}
+
+	o := sectionOptions{validate: noValidateFunc}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	allSections[key] = section{
+		key:         key,
+		mapToStruct: reflectMapToStruct(structType, o.decodeHook),
+		validate:    o.validate,
+		decodeHook:  o.decodeHook,
+		defaults:    defaults,
+		docs:        o.docs,
+		secret:      o.secret,
+	}
+	if o.toMapHook != nil {
+		allSectionDecodeHookFuncs = append(allSectionDecodeHookFuncs, o.toMapHook)
+	}
+	return nil
+}
+
+// reflectMapToStruct makes a mapToStruct function for the given struct type.
+func reflectMapToStruct(structType reflect.Type, decodeHook mapstructure.DecodeHookFunc) func(map[string]interface{}) (interface{}, error) {
+	return func(m map[string]interface{}) (interface{}, error) {
+		s := reflect.New(structType)
+		if err := decodeStructFromMap(s.Interface(), m, decodeHook); err != nil {
+			return nil, err
+		}
+		return s.Elem().Interface(), nil
+	}
+}
+
+// SectionKeys returns the keys of all the registered sections in order.
+func SectionKeys() []string {
+	keys := make([]string, 0, len(allSections))
+	for key := range allSections {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// IsSecretSection returns true if the values of the section are secret and
+// should be redacted when shown.
+func IsSecretSection(key string) bool {
+	return allSections[key].secret
+}
+
+// FieldDocs returns the field descriptions given for a section.
+func FieldDocs(key string) (map[string]string, error) {
+	section, ok := allSections[key]
+	if !ok {
+		return nil, notSectionKeyError(key)
+	}
+	docs := map[string]string{}
+	for field, doc := range section.docs {
+		docs[field] = doc
+	}
+	return docs, nil
+}
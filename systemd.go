@@ -0,0 +1,40 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"github.com/godbus/dbus/v5"
+)
+
+// SystemdRestarter restarts systemd units through D-Bus. Units that are not
+// running are not started.
+type SystemdRestarter struct {
+	conn *dbus.Conn
+}
+
+func NewSystemdRestarter() (*SystemdRestarter, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return &SystemdRestarter{conn: conn}, nil
+}
+
+func (r *SystemdRestarter) RestartUnit(unit string) error {
+	obj := r.conn.Object("org.freedesktop.systemd1", "/org/freedesktop/systemd1")
+	return obj.Call("org.freedesktop.systemd1.Manager.TryRestartUnit", 0, unit, "replace").Err
+}
@@ -16,15 +16,21 @@
 
 package config
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 const TestHostsKey = "test-hosts"
 
+var TestHostsSection = TypedSection[TestHosts]{key: TestHostsKey}
+
 func init() {
 	allSections[TestHostsKey] = section{
 		key:         TestHostsKey,
 		mapToStruct: testHostsMapToStruct,
-		validate:    noValidateFunc,
+		validate:    validateTestHosts,
+		defaults:    DefaultTestHosts(),
 	}
 }
 
@@ -49,3 +55,23 @@ func testHostsMapToStruct(m map[string]interface{}) (interface{}, error) {
 	}
 	return s, nil
 }
+
+func validateTestHosts(s interface{}) error {
+	h, ok := s.(TestHosts)
+	if !ok {
+		return nil
+	}
+	errs := newFieldErrors(TestHostsKey)
+	for i, url := range h.URLs {
+		if url == "" {
+			errs.add(fmt.Sprintf("urls[%d]", i), url, "can not be empty")
+		}
+	}
+	if h.PingWaitTime < 0 {
+		errs.add("ping-wait-time", h.PingWaitTime, "can not be negative")
+	}
+	if h.PingRetries < 0 {
+		errs.add("ping-retries", h.PingRetries, "can not be negative")
+	}
+	return errs.err()
+}
@@ -18,16 +18,20 @@ package config
 
 const ThermalMotionKey = "thermal-motion"
 
+var ThermalMotionSection = TypedSection[ThermalMotion]{key: ThermalMotionKey}
+
 func init() {
 	allSections[ThermalMotionKey] = section{
 		key:         ThermalMotionKey,
 		mapToStruct: thermalMotionMapToStruct,
-		validate:    noValidateFunc,
+		validate:    validateThermalMotion,
+		defaults:    DefaultThermalMotion(),
+		legacyKeys:  map[string]string{"min-secs": "dynamic-threshold"},
 	}
 }
 
 type ThermalMotion struct {
-	DynamicThreshold bool   `mapstructure:"min-secs"`
+	DynamicThreshold bool   `mapstructure:"dynamic-threshold"`
 	TempThresh       uint16 `mapstructure:"temp-thresh"`
 	DeltaThresh      uint16 `mapstructure:"delta-thresh"`
 	CountThresh      int    `mapstructure:"count-thresh"`
@@ -56,8 +60,31 @@ func DefaultThermalMotion() ThermalMotion {
 
 func thermalMotionMapToStruct(m map[string]interface{}) (interface{}, error) {
 	var s ThermalMotion
-	if err := decodeStructFromMap(&s, m, nil); err != nil {
+	if err := decodeStructFromMap(&s, withoutLegacyKeys(ThermalMotionKey, m), nil); err != nil {
 		return nil, err
 	}
 	return s, nil
 }
+
+func validateThermalMotion(s interface{}) error {
+	m, ok := s.(ThermalMotion)
+	if !ok {
+		return nil
+	}
+	errs := newFieldErrors(ThermalMotionKey)
+	counts := []struct {
+		name  string
+		value int
+	}{
+		{"count-thresh", m.CountThresh},
+		{"frame-compare-gap", m.FrameCompareGap},
+		{"trigger-frames", m.TriggerFrames},
+		{"edge-pixels", m.EdgePixels},
+	}
+	for _, count := range counts {
+		if count.value < 0 {
+			errs.add(count.name, count.value, "can not be negative")
+		}
+	}
+	return errs.err()
+}
@@ -18,11 +18,14 @@ package config
 
 const ThermalRecorderKey = "thermal-recorder"
 
+var ThermalRecorderSection = TypedSection[ThermalRecorder]{key: ThermalRecorderKey}
+
 func init() {
 	allSections[ThermalRecorderKey] = section{
 		key:         ThermalRecorderKey,
 		mapToStruct: thermalRecorderMapToStruct,
-		validate:    noValidateFunc,
+		validate:    validateThermalRecorder,
+		defaults:    DefaultThermalRecorder(),
 	}
 }
 
@@ -51,3 +54,21 @@ func thermalRecorderMapToStruct(m map[string]interface{}) (interface{}, error) {
 	}
 	return s, nil
 }
+
+func validateThermalRecorder(s interface{}) error {
+	r, ok := s.(ThermalRecorder)
+	if !ok {
+		return nil
+	}
+	errs := newFieldErrors(ThermalRecorderKey)
+	if r.MinSecs < 0 {
+		errs.add("min-secs", r.MinSecs, "can not be negative")
+	}
+	if r.MinSecs > r.MaxSecs {
+		errs.add("max-secs", r.MaxSecs, "can not be less than min-secs")
+	}
+	if r.PreviewSecs < 0 {
+		errs.add("preview-secs", r.PreviewSecs, "can not be negative")
+	}
+	return errs.err()
+}
@@ -20,11 +20,14 @@ import "time"
 
 const ThermalThrottlerKey = "thermal-throttler"
 
+var ThermalThrottlerSection = TypedSection[ThermalThrottler]{key: ThermalThrottlerKey}
+
 func init() {
 	allSections[ThermalThrottlerKey] = section{
 		key:         ThermalThrottlerKey,
 		mapToStruct: thermalThrottlerMapToStruct,
-		validate:    noValidateFunc,
+		validate:    validateThermalThrottler,
+		defaults:    DefaultThermalThrottler(),
 	}
 }
 
@@ -50,3 +53,18 @@ func thermalThrottlerMapToStruct(m map[string]interface{}) (interface{}, error)
 	}
 	return s, nil
 }
+
+func validateThermalThrottler(s interface{}) error {
+	t, ok := s.(ThermalThrottler)
+	if !ok {
+		return nil
+	}
+	errs := newFieldErrors(ThermalThrottlerKey)
+	if t.BucketSize < 0 {
+		errs.add("bucket-size", t.BucketSize, "can not be negative")
+	}
+	if t.MinRefill < 0 {
+		errs.add("min-refill", t.MinRefill, "can not be negative")
+	}
+	return errs.err()
+}
@@ -0,0 +1,128 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import "time"
+
+// Tx is used to change several sections in a Transaction.
+type Tx struct {
+	c        *Config
+	sections map[string]struct{}
+}
+
+// Transaction runs f while holding the file lock for the whole call. The
+// latest config is read in once before f and all changes made through tx
+// are validated and written once after f. If f or the write returns an
+// error none of the changes are kept.
+func (c *Config) Transaction(f func(tx *Tx) error) error {
+	return c.mutate("Transaction", true, func() error {
+		tx := &Tx{
+			c:        c,
+			sections: map[string]struct{}{},
+		}
+		if err := f(tx); err != nil {
+			return err
+		}
+		return tx.validate()
+	})
+}
+
+// Updated is the transaction equivalent of Config.Updated. It includes the
+// changes made in the transaction.
+func (tx *Tx) Updated(sectionKey string) time.Time {
+	return tx.c.Updated(sectionKey)
+}
+
+// SectionValues is the transaction equivalent of Config.SectionValues. It
+// includes the changes made in the transaction.
+func (tx *Tx) SectionValues(key string) (map[string]interface{}, error) {
+	return tx.c.SectionValues(key)
+}
+
+// Set is the transaction equivalent of Config.Set.
+func (tx *Tx) Set(key string, value interface{}) error {
+	tx.sections[key] = struct{}{}
+	return tx.c.setAt(key, value, now(), false)
+}
+
+// StrictSet is the transaction equivalent of Config.StrictSet.
+func (tx *Tx) StrictSet(key string, value interface{}, updated time.Time) error {
+	tx.sections[key] = struct{}{}
+	return tx.c.setAt(key, value, updated, true)
+}
+
+// SetFromMap is the transaction equivalent of Config.SetFromMap.
+func (tx *Tx) SetFromMap(sectionKey string, newConfig map[string]interface{}) error {
+	tx.sections[sectionKey] = struct{}{}
+	return tx.c.setFromMapAt(sectionKey, newConfig, now(), false)
+}
+
+// SetField is the transaction equivalent of Config.SetField.
+func (tx *Tx) SetField(sectionKey, fieldPath, value string) error {
+	tx.sections[sectionKey] = struct{}{}
+	return tx.c.setField(sectionKey, fieldPath, value)
+}
+
+// RemoveField is the transaction equivalent of Config.RemoveField.
+func (tx *Tx) RemoveField(sectionKey, fieldPath string) error {
+	tx.sections[sectionKey] = struct{}{}
+	return tx.c.removeField(sectionKey, fieldPath)
+}
+
+// Patch is the transaction equivalent of Config.Patch.
+func (tx *Tx) Patch(sectionKey string, patch []byte) error {
+	tx.sections[sectionKey] = struct{}{}
+	return tx.c.patch(sectionKey, patch)
+}
+
+// Unset is the transaction equivalent of Config.Unset.
+func (tx *Tx) Unset(key string) error {
+	return tx.c.unset(key)
+}
+
+// UnsetField is the transaction equivalent of Config.UnsetField.
+func (tx *Tx) UnsetField(sectionKey, field string) error {
+	tx.sections[sectionKey] = struct{}{}
+	return tx.c.unsetField(sectionKey, field)
+}
+
+// ResetToDefault is the transaction equivalent of Config.ResetToDefault.
+func (tx *Tx) ResetToDefault(sectionKey string, fields ...string) error {
+	tx.sections[sectionKey] = struct{}{}
+	return tx.c.resetToDefault(sectionKey, fields...)
+}
+
+// validate checks every section changed in the transaction.
+func (tx *Tx) validate() error {
+	for key := range tx.sections {
+		if !checkIfSectionKey(key) || !tx.c.v.IsSet(key) {
+			continue
+		}
+		m := map[string]interface{}{}
+		if err := tx.c.v.UnmarshalKey(key, &m); err != nil {
+			return err
+		}
+		s, err := allSections[key].mapToStruct(withoutUpdated(m))
+		if err != nil {
+			return err
+		}
+		if err := validateSection(key, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import "context"
+
+// TypedSection ties the key of a section to its struct type T, so the
+// section can only be loaded into or saved from a T. The defaults,
+// validator and decode hooks come from the registered section. The
+// TypedSections for the sections in this package are the <Name>Section
+// variables, other sections can get one from RegisterTypedSection.
+type TypedSection[T any] struct {
+	key string
+}
+
+// RegisterTypedSection is the same as RegisterSection but returns a
+// TypedSection for the new section.
+func RegisterTypedSection[T any](key string, defaults T, opts ...SectionOption) (TypedSection[T], error) {
+	if err := RegisterSection(key, defaults, opts...); err != nil {
+		return TypedSection[T]{}, err
+	}
+	return TypedSection[T]{key: key}, nil
+}
+
+// Key returns the key of the section.
+func (s TypedSection[T]) Key() string {
+	return s.key
+}
+
+// Defaults returns a copy of the defaults of the section.
+func (s TypedSection[T]) Defaults() (T, error) {
+	var t T
+	defaults, err := sectionDefaults(s.key)
+	if err != nil {
+		return t, err
+	}
+	return defaults.(T), nil
+}
+
+// Load returns the section with the values in the config file layered over
+// the defaults.
+func (s TypedSection[T]) Load(c *Config) (T, error) {
+	var t T
+	err := c.Section(s.key, &t)
+	return t, err
+}
+
+// Save sets the section to t.
+func (s TypedSection[T]) Save(c *Config, t T) error {
+	if !checkIfSectionKey(s.key) {
+		return notSectionKeyError(s.key)
+	}
+	return c.Set(s.key, t)
+}
+
+// Watch is the typed equivalent of Config.Watch.
+func (s TypedSection[T]) Watch(ctx context.Context, c *Config) (<-chan T, error) {
+	ch, err := c.Watch(ctx, s.key)
+	if err != nil {
+		return nil, err
+	}
+	typedCh := make(chan T, 1)
+	go func() {
+		defer close(typedCh)
+		for section := range ch {
+			select {
+			case typedCh <- section.(T):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return typedCh, nil
+}
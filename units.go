@@ -0,0 +1,195 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// UnitRestarter restarts systemd units.
+type UnitRestarter interface {
+	RestartUnit(unit string) error
+}
+
+// currentUnit returns the systemd unit of this process, or "" if it is not
+// running in a unit.
+var currentUnit = func() string {
+	data, err := afero.ReadFile(afero.NewOsFs(), "/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+	return unitFromCgroup(string(data))
+}
+
+// unitFromCgroup returns the systemd unit from the contents of
+// /proc/<pid>/cgroup, e.g. "0::/system.slice/thermal-recorder.service".
+func unitFromCgroup(cgroup string) string {
+	for _, line := range strings.Split(cgroup, "\n") {
+		spl := strings.SplitN(line, ":", 3)
+		if len(spl) != 3 || (spl[1] != "" && spl[1] != "name=systemd") {
+			continue
+		}
+		parts := strings.Split(spl[2], "/")
+		for i := len(parts) - 1; i >= 0; i-- {
+			if strings.HasSuffix(parts[i], ".service") {
+				return parts[i]
+			}
+		}
+	}
+	return ""
+}
+
+func unitsFilePath(configFile string) string {
+	return configFile + ".units"
+}
+
+// AccessedSections returns the sections that have been read from the config.
+func (c *Config) AccessedSections() []string {
+	sections := make([]string, 0, len(c.accessedSections))
+	for section := range c.accessedSections {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+	return sections
+}
+
+// recordAccess records that the section has been read. The first time a
+// section is read it is added to the sections of the systemd unit of this
+// process in the units file, so the unit can be restarted when the section
+// changes. Nothing is recorded if RecordAccess is false.
+func (c *Config) recordAccess(sectionKey string) {
+	if _, ok := c.accessedSections[sectionKey]; ok || !c.RecordAccess {
+		return
+	}
+	c.accessedSections[sectionKey] = struct{}{}
+	unit := currentUnit()
+	if unit == "" {
+		return
+	}
+	c.addUnitSection(unit, sectionKey)
+}
+
+// addUnitSection adds the sections read by this process to the sections of
+// the unit in the units file, unless the unit already has the section.
+// The units file has its own lock, which is taken even in read only mode as
+// the units file is not part of the config.
+func (c *Config) addUnitSection(unit, sectionKey string) error {
+	if err := c.unitsLock.rlock(); err != nil {
+		return err
+	}
+	units, err := readUnits(c.v.ConfigFileUsed())
+	c.unitsLock.unlock()
+	if err != nil || contains(units[unit], sectionKey) {
+		return err
+	}
+
+	if err := c.unitsLock.acquire(true); err != nil {
+		return err
+	}
+	defer c.unitsLock.unlock()
+	// Another process might have added the section since the shared lock was released.
+	units, err = readUnits(c.v.ConfigFileUsed())
+	if err != nil || contains(units[unit], sectionKey) {
+		return err
+	}
+	for _, section := range c.AccessedSections() {
+		if !contains(units[unit], section) {
+			units[unit] = append(units[unit], section)
+		}
+	}
+	sort.Strings(units[unit])
+	data, err := json.MarshalIndent(units, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(unitsFilePath(c.v.ConfigFileUsed()), data)
+}
+
+func readUnits(configFile string) (map[string][]string, error) {
+	units := map[string][]string{}
+	data, err := afero.ReadFile(fs, unitsFilePath(configFile))
+	if os.IsNotExist(err) {
+		return units, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return units, json.Unmarshal(data, &units)
+}
+
+// UnitsForSections returns the systemd units that have read any of the
+// sections.
+func (c *Config) UnitsForSections(sections []string) ([]string, error) {
+	if err := c.unitsLock.rlock(); err != nil {
+		return nil, err
+	}
+	defer c.unitsLock.unlock()
+	units, err := readUnits(c.v.ConfigFileUsed())
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for unit, unitSections := range units {
+		for _, section := range unitSections {
+			if contains(sections, section) {
+				result = append(result, unit)
+				break
+			}
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// RestartUnits restarts the systemd units, other than the unit of this
+// process, that have read any of the sections. The units that were
+// restarted are returned.
+func (c *Config) RestartUnits(sections []string) ([]string, error) {
+	if c.Restarter == nil {
+		return nil, errors.New("no unit restarter is set")
+	}
+	units, err := c.UnitsForSections(sections)
+	if err != nil {
+		return nil, err
+	}
+	restarted := []string{}
+	self := currentUnit()
+	for _, unit := range units {
+		if unit == self {
+			continue
+		}
+		if err := c.Restarter.RestartUnit(unit); err != nil {
+			return restarted, err
+		}
+		restarted = append(restarted, unit)
+	}
+	return restarted, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// UnsetField removes a field from the section in the config file so the
+// default value of the field is used.
+func (c *Config) UnsetField(sectionKey, field string) error {
+	return c.mutate("UnsetField", c.AutoWrite, func() error {
+		return c.unsetField(sectionKey, field)
+	})
+}
+
+// ResetToDefault removes the given fields of the section from the config
+// file, or the whole section if no fields are given, so the defaults are
+// used.
+func (c *Config) ResetToDefault(sectionKey string, fields ...string) error {
+	return c.mutate("ResetToDefault", c.AutoWrite, func() error {
+		return c.resetToDefault(sectionKey, fields...)
+	})
+}
+
+func (c *Config) resetToDefault(sectionKey string, fields ...string) error {
+	if !checkIfSectionKey(sectionKey) {
+		return notSectionKeyError(sectionKey)
+	}
+	if len(fields) == 0 {
+		return c.unset(sectionKey)
+	}
+	for _, field := range fields {
+		if err := c.unsetField(sectionKey, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) unsetField(sectionKey, field string) error {
+	defaults, err := sectionDefaults(sectionKey)
+	if err != nil {
+		return err
+	}
+	field = strings.ToLower(field)
+	if _, ok := structFields(reflect.TypeOf(defaults))[field]; !ok {
+		return fmt.Errorf("'%s' is not a field in section '%s'", field, sectionKey)
+	}
+	settings := c.v.AllSettings()
+	m, ok := settings[sectionKey].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if _, ok := m[field]; !ok {
+		return nil // Already using the default.
+	}
+	delete(m, field)
+	s, err := decodeOverDefaults(sectionKey, c.withLowerLayers(sectionKey, withoutUpdated(m)))
+	if err != nil {
+		return err
+	}
+	if err := validateSection(sectionKey, s); err != nil {
+		return err
+	}
+	// Setting "updated" with viper after the reset would hide the rest of
+	// the section from Get, so it is added before.
+	m["updated"] = now()
+	return c.resetSettings(settings)
+}
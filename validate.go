@@ -0,0 +1,110 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// FieldError describes why a field in a section is not valid.
+type FieldError struct {
+	Section string
+	Field   string
+	Value   interface{}
+	Reason  string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("invalid value '%v' for '%s.%s': %s", e.Value, e.Section, e.Field, e.Reason)
+}
+
+// ValidationError holds every field error found when validating a section.
+type ValidationError []*FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, fieldErr := range e {
+		msgs[i] = fieldErr.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// fieldErrors is used by the section validators to collect field errors.
+type fieldErrors struct {
+	section string
+	errs    ValidationError
+}
+
+func newFieldErrors(section string) *fieldErrors {
+	return &fieldErrors{section: section}
+}
+
+func (f *fieldErrors) add(field string, value interface{}, reason string) {
+	f.errs = append(f.errs, &FieldError{
+		Section: f.section,
+		Field:   field,
+		Value:   value,
+		Reason:  reason,
+	})
+}
+
+func (f *fieldErrors) err() error {
+	if len(f.errs) == 0 {
+		return nil
+	}
+	return f.errs
+}
+
+// validateSection runs the validator of the section on s. s can be the
+// section struct or a pointer to it, but not nil.
+func validateSection(key string, s interface{}) error {
+	section, ok := allSections[key]
+	if !ok {
+		return notSectionKeyError(key)
+	}
+	v := reflect.ValueOf(s)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() || v.Kind() == reflect.Ptr {
+		return fmt.Errorf("no value given for section '%s'", key)
+	}
+	return section.validate(v.Interface())
+}
+
+// validateValue validates a value given to Set. Maps are checked by
+// decoding them into the section struct first.
+func validateValue(key string, value interface{}) error {
+	if reflect.ValueOf(value).Kind() != reflect.Map {
+		return validateSection(key, value)
+	}
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("can not set '%s' from a %T", key, value)
+	}
+	s, err := allSections[key].mapToStruct(withoutUpdated(m))
+	if err != nil {
+		return err
+	}
+	return validateSection(key, s)
+}
+
+func noValidateFunc(s interface{}) error {
+	return nil
+}
@@ -0,0 +1,160 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+var watchInterval = 2 * time.Second
+
+// Watch polls the config file for changes and sends the section on the
+// returned channel each time its contents change. The value sent is the
+// section struct with the values from the file layered over the defaults.
+// Only config.toml, or the secrets file for secret sections, is watched, the
+// values from the other layers are the ones read in when Watch was called.
+// The channel is closed when ctx is done.
+func (c *Config) Watch(ctx context.Context, sectionKey string) (<-chan interface{}, error) {
+	if !checkIfSectionKey(sectionKey) {
+		return nil, notSectionKeyError(sectionKey)
+	}
+	configFile := c.v.ConfigFileUsed()
+	secret := IsSecretSection(sectionKey)
+	if secret {
+		configFile = secretsFilePath(configFile)
+	}
+	w := &watcher{
+		configFile: configFile,
+		optional:   secret,
+		fileLock:   newFileLock(lockFilePath(configFile), c.fileLock.readOnly),
+		section:    allSections[sectionKey],
+		lower:      c.lowerLayers,
+		upper:      c.upperLayers,
+	}
+	if err := w.stat(); err != nil {
+		return nil, err
+	}
+	raw, err := w.readSection()
+	if err != nil {
+		return nil, err
+	}
+	w.last = raw
+	c.recordAccess(sectionKey)
+
+	ch := make(chan interface{}, 1)
+	go w.run(ctx, ch)
+	return ch, nil
+}
+
+type watcher struct {
+	configFile string
+	optional   bool // The file might not exist, as with the secrets file.
+	fileLock   *fileLock
+	section    section
+	lower      []layer
+	upper      []layer
+	modTime    time.Time
+	size       int64
+	last       map[string]interface{}
+}
+
+func (w *watcher) run(ctx context.Context, ch chan<- interface{}) {
+	defer close(ch)
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s, ok := w.poll()
+		if !ok {
+			continue
+		}
+		select {
+		case ch <- s:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// poll returns the section if it has changed since the last poll.
+func (w *watcher) poll() (interface{}, bool) {
+	modTime, size := w.modTime, w.size
+	if err := w.stat(); err != nil || (w.modTime.Equal(modTime) && w.size == size) {
+		return nil, false
+	}
+	raw, err := w.readSection()
+	if err != nil || reflect.DeepEqual(raw, w.last) {
+		return nil, false
+	}
+	m := mergeSectionLayers(w.section.key, w.lower, withoutUpdated(raw), w.upper)
+	s, err := decodeOverDefaults(w.section.key, m)
+	if err != nil {
+		return nil, false
+	}
+	w.last = raw
+	return s, true
+}
+
+func (w *watcher) stat() error {
+	info, err := fs.Stat(w.configFile)
+	if os.IsNotExist(err) && w.optional {
+		w.modTime, w.size = time.Time{}, 0
+		return nil
+	} else if err != nil {
+		return err
+	}
+	w.modTime = info.ModTime()
+	w.size = info.Size()
+	return nil
+}
+
+func (w *watcher) readSection() (map[string]interface{}, error) {
+	if err := w.fileLock.rlock(); err != nil {
+		return nil, err
+	}
+	defer w.fileLock.unlock()
+	if exists, err := afero.Exists(fs, w.configFile); err == nil && !exists && w.optional {
+		return map[string]interface{}{}, nil
+	}
+	v := viper.New()
+	v.SetFs(fs)
+	v.SetConfigFile(w.configFile)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	return v.GetStringMap(w.section.key), nil
+}
+
+func withoutUpdated(m map[string]interface{}) map[string]interface{} {
+	s := map[string]interface{}{}
+	for k, v := range m {
+		if k != "updated" {
+			s[k] = v
+		}
+	}
+	return s
+}
@@ -16,16 +16,21 @@
 
 package config
 
+import "time"
+
 func init() {
 	allSections[WindowsKey] = section{
 		key:         WindowsKey,
 		mapToStruct: windowsMapToStruct,
-		validate:    noValidateFunc,
+		validate:    validateWindows,
+		defaults:    DefaultWindows(),
 	}
 }
 
 const WindowsKey = "windows"
 
+var WindowsSection = TypedSection[Windows]{key: WindowsKey}
+
 type Windows struct {
 	StartRecording string `mapstructure:"start-recording"`
 	StopRecording  string `mapstructure:"stop-recording"`
@@ -42,10 +47,6 @@ func DefaultWindows() Windows {
 	}
 }
 
-func noValidateFunc(s interface{}) error {
-	return nil
-}
-
 func windowsMapToStruct(m map[string]interface{}) (interface{}, error) {
 	var s Windows
 	if err := decodeStructFromMap(&s, m, nil); err != nil {
@@ -53,3 +54,38 @@ func windowsMapToStruct(m map[string]interface{}) (interface{}, error) {
 	}
 	return s, nil
 }
+
+func validateWindows(s interface{}) error {
+	w, ok := s.(Windows)
+	if !ok {
+		return nil
+	}
+	errs := newFieldErrors(WindowsKey)
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"start-recording", w.StartRecording},
+		{"stop-recording", w.StopRecording},
+		{"power-on", w.PowerOn},
+		{"power-off", w.PowerOff},
+	}
+	for _, field := range fields {
+		if !isWindowTime(field.value) {
+			errs.add(field.name, field.value, "must be a time of day (15:04) or an offset from sunrise/sunset (-30m)")
+		}
+	}
+	return errs.err()
+}
+
+func isWindowTime(s string) bool {
+	if s == "" {
+		return true
+	}
+	if s[0] == '+' || s[0] == '-' {
+		_, err := time.ParseDuration(s)
+		return err == nil
+	}
+	_, err := time.Parse("15:04", s)
+	return err == nil
+}
@@ -0,0 +1,141 @@
+// go-config - Library for reading cacophony config files.
+// Copyright (C) 2018, The Cacophony Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bytes"
+	"os"
+	"path"
+
+	"github.com/spf13/afero"
+
+	toml "github.com/pelletier/go-toml"
+)
+
+const defaultConfigFileMode = 0644
+
+// writeConfig writes all the settings to the config file, records the write
+// in the history and keeps a copy of them as the last known good config.
+// Errors recording the write or keeping the copy are ignored, see mutate.
+// The schema version is added if the config doesn't have one. The secret
+// sections are written to the secrets file instead, unless it couldn't be
+// read. If writing the config file fails the old secrets file is put back
+// so neither file is changed.
+func (c *Config) writeConfig() (err error) {
+	settings := c.v.AllSettings()
+	if c.secretsErr == nil {
+		var restoreSecrets func() error
+		if restoreSecrets, err = c.writeSecrets(splitSecrets(settings)); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				restoreSecrets()
+			}
+		}()
+	}
+	if _, ok := settings[SchemaVersionKey]; !ok && SchemaVersion() > 0 {
+		settings[SchemaVersionKey] = SchemaVersion()
+	}
+	tomlTree, err := toml.TreeFromMap(settings)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if _, err := tomlTree.WriteTo(&buf); err != nil {
+		return err
+	}
+	configFile := c.v.ConfigFileUsed()
+	old, err := afero.ReadFile(fs, configFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := writeFileAtomic(configFile, buf.Bytes()); err != nil {
+		return err
+	}
+	recordHistory(configFile, old, buf.Bytes())
+	updateGoodFile(configFile, buf.Bytes())
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// filename and then renames it over filename, so filename will either have
+// the old or new contents if power is lost while writing. The mode and owner
+// of an existing file are kept.
+func writeFileAtomic(filename string, data []byte) error {
+	return writeFileAtomicMode(filename, data, 0)
+}
+
+// writeFileAtomicMode is writeFileAtomic with the mode of the file set to
+// mode, or kept as it was if mode is 0.
+func writeFileAtomicMode(filename string, data []byte, mode os.FileMode) error {
+	dir := path.Dir(filename)
+	info, err := fs.Stat(filename)
+	if err == nil && mode == 0 {
+		mode = info.Mode().Perm()
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if mode == 0 {
+		mode = defaultConfigFileMode
+	}
+
+	tmp, err := afero.TempFile(fs, dir, "."+path.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	renamed := false
+	defer func() {
+		if !renamed {
+			fs.Remove(tmpName)
+		}
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := fs.Chmod(tmpName, mode); err != nil {
+		return err
+	}
+	if info != nil {
+		if err := chown(tmpName, info); err != nil {
+			return err
+		}
+	}
+	if err := fs.Rename(tmpName, filename); err != nil {
+		return err
+	}
+	renamed = true
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := fs.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}